@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/config"
+	eventlog "github.com/dan-mcdonald/fasthacker/internal/event-log"
+	eventstore "github.com/dan-mcdonald/fasthacker/internal/event-store"
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+	"github.com/dan-mcdonald/fasthacker/internal/sync"
+	"github.com/dan-mcdonald/fasthacker/internal/web"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const shutdownTimeout = 30 * time.Second
+
+// waitForInterrupt blocks until the process is interrupted, or terminated
+// as systemd and container runtimes stop it.
+func waitForInterrupt() {
+	chInterrupt := make(chan os.Signal, 1)
+	signal.Notify(chInterrupt, os.Interrupt, syscall.SIGTERM)
+	sig := <-chInterrupt
+	fmt.Printf("%v received, shutting down\n", sig)
+}
+
+// runSync syncs from upstream until interrupted, serving the web UI too if
+// withWeb is set.
+func runSync(cfg config.Config, withWeb bool) error {
+	fmt.Println("hacker-sync starting")
+	synk := sync.NewSync(cfg.Sync)
+	if err := synk.Start(context.Background()); err != nil {
+		return err
+	}
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
+	metricsSrv := &http.Server{Addr: cfg.Metrics.Addr, Handler: metricsMux}
+	go func() {
+		log.Printf("starting metrics server http://%s/metrics", cfg.Metrics.Addr)
+		if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	var webSrv *http.Server
+	if withWeb {
+		webSrv = web.NewServer(<-synk.EventStore(), cfg.Web.Addr)
+		go web.Start(webSrv)
+	}
+	waitForInterrupt()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if webSrv != nil {
+		if err := webSrv.Shutdown(ctx); err != nil {
+			log.Printf("web shutdown: %v", err)
+		}
+	}
+	if err := synk.Shutdown(ctx); err != nil {
+		log.Printf("sync shutdown: %v", err)
+	}
+	if err := metricsSrv.Shutdown(ctx); err != nil {
+		log.Printf("metrics shutdown: %v", err)
+	}
+	fmt.Println("hacker-sync stopped")
+	return nil
+}
+
+// openStored opens the configured event log for the commands that only read
+// it, read-only and without migrating it.
+func openStored(cfg config.Config) (eventlog.EventLog, error) {
+	switch cfg.Sync.Backend {
+	case eventlog.BackendSQLite:
+		return eventlog.OpenReadOnly(cfg.Sync.DBPath)
+	case eventlog.BackendPostgres:
+		return eventlog.OpenPostgresReadOnly(cfg.Sync.DBPath)
+	case eventlog.BackendSegments:
+		return eventlog.OpenSegmentsReadOnly(cfg.Sync.DBPath)
+	}
+	return nil, fmt.Errorf("the %s backend keeps nothing between runs", cfg.Sync.Backend)
+}
+
+// openGorm opens the configured event log read-only for the commands that
+// need SQL.
+func openGorm(cfg config.Config) (*eventlog.GormLog, error) {
+	return asGorm(cfg, openStored)
+}
+
+// openWritableGorm opens the configured event log for the commands that
+// need SQL and write to it, migrating it first.
+func openWritableGorm(cfg config.Config) (*eventlog.GormLog, error) {
+	return asGorm(cfg, func(cfg config.Config) (eventlog.EventLog, error) {
+		return eventlog.Open(cfg.Sync.Backend, cfg.Sync.DBPath)
+	})
+}
+
+func asGorm(cfg config.Config, open func(config.Config) (eventlog.EventLog, error)) (*eventlog.GormLog, error) {
+	eventLog, err := open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	gormLog, ok := eventLog.(*eventlog.GormLog)
+	if !ok {
+		eventLog.Close()
+		return nil, fmt.Errorf("not supported by the %s backend", cfg.Sync.Backend)
+	}
+	return gormLog, nil
+}
+
+// serve runs the web UI against the event log as it is, opened read-only
+// and without syncing, so it works offline on a copied database.
+func serve(cfg config.Config) error {
+	eventLog, err := openStored(cfg)
+	if err != nil {
+		return err
+	}
+	defer eventLog.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	es := eventstore.NewEventStore()
+	go es.Serve(ctx, eventLog)
+	webSrv := web.NewServer(es, cfg.Web.Addr)
+	go web.Start(webSrv)
+	waitForInterrupt()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	return webSrv.Shutdown(shutdownCtx)
+}
+
+// get prints an item as JSON, or with -thread an outline of the item and
+// every reply below it.
+func get(cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	thread := fs.Bool("thread", false, "print the item and its replies as an outline")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: get [-thread] <id>")
+	}
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad item id %q: %w", fs.Arg(0), err)
+	}
+	eventLog, err := openStored(cfg)
+	if err != nil {
+		return err
+	}
+	defer eventLog.Close()
+	if *thread {
+		return printThread(eventLog, model.ItemID(id), 0)
+	}
+	item, err := eventLog.GetLatestItem(model.ItemID(id))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(item)
+}
+
+func printThread(eventLog eventlog.EventLog, id model.ItemID, depth int) error {
+	indent := strings.Repeat("  ", depth)
+	item, err := eventLog.GetLatestItem(id)
+	if errors.Is(err, eventlog.ErrNotFound) {
+		fmt.Printf("%s%d (not stored)\n", indent, id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	by := ""
+	if item.By != nil {
+		by = string(*item.By)
+	}
+	text := ""
+	switch {
+	case item.Title != nil:
+		text = *item.Title
+	case item.Text != nil:
+		text = *item.Text
+	}
+	if len(text) > 80 {
+		text = text[:77] + "..."
+	}
+	fmt.Printf("%s%d %s %s: %s\n", indent, item.ID, item.Type, by, text)
+	if item.Kids == nil {
+		return nil
+	}
+	for _, kid := range *item.Kids {
+		if err := printThread(eventLog, kid, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stats(cfg config.Config) error {
+	eventLog, err := openGorm(cfg)
+	if err != nil {
+		return err
+	}
+	defer eventLog.Close()
+	s, err := eventLog.Stats()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "items\t%d\t(%d revisions, %d unchanged observations)\n", s.Items, s.ItemEvents, s.ItemObservations)
+	fmt.Fprintf(w, "missing items\t%d\t(in %d gaps)\n", s.MissingItems, s.Gaps)
+	fmt.Fprintf(w, "uncompressed items\t%d\t(dictionary version %d)\n", s.RawPayloads, s.Dictionary)
+	fmt.Fprintf(w, "users\t%d\t(%d revisions)\n", s.Users, s.UserEvents)
+	fmt.Fprintf(w, "list snapshots\t%d\t\n", s.ListEvents)
+	fmt.Fprintf(w, "failed fetches\t%d\t\n", s.FailedFetches)
+	fmt.Fprintf(w, "transitions\t%d\t\n", s.Transitions)
+	fmt.Fprintf(w, "last item rx\t%s\t\n", formatRx(s.LastItemRx))
+	fmt.Fprintf(w, "last user rx\t%s\t\n", formatRx(s.LastUserRx))
+	fmt.Fprintf(w, "last list rx\t%s\t\n", formatRx(s.LastListRx))
+	return w.Flush()
+}
+
+func formatRx(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%s ago)", t.Format(time.RFC3339), time.Since(t).Round(time.Second))
+}
+
+func vacuum(cfg config.Config) error {
+	if cfg.Sync.Backend != eventlog.BackendSQLite {
+		eventLog, err := openWritableGorm(cfg)
+		if err != nil {
+			return err
+		}
+		defer eventLog.Close()
+		return eventLog.Vacuum()
+	}
+	before, err := os.Stat(cfg.Sync.DBPath)
+	if err != nil {
+		return err
+	}
+	eventLog, err := eventlog.NewEventLog(cfg.Sync.DBPath)
+	if err != nil {
+		return err
+	}
+	defer eventLog.Close()
+	if err := eventLog.Vacuum(); err != nil {
+		return err
+	}
+	after, err := os.Stat(cfg.Sync.DBPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d bytes -> %d bytes\n", cfg.Sync.DBPath, before.Size(), after.Size())
+	return nil
+}
+
+// train trains a new compression dictionary on the most recent items.
+func train(cfg config.Config) error {
+	eventLog, err := openWritableGorm(cfg)
+	if err != nil {
+		return err
+	}
+	defer eventLog.Close()
+	version, err := eventLog.TrainDictionary()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("trained dictionary version %d\n", version)
+	return nil
+}
+
+// replay rebuilds another event log from the configured segment log, e.g.
+// a fresh SQLite database for querying.
+func replay(cfg config.Config, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: replay <backend> <db>")
+	}
+	if cfg.Sync.Backend != eventlog.BackendSegments {
+		return fmt.Errorf("replay reads a segments event log, not %s", cfg.Sync.Backend)
+	}
+	src, err := eventlog.OpenSegmentsReadOnly(cfg.Sync.DBPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := eventlog.Open(eventlog.Backend(args[0]), args[1])
+	if err != nil {
+		return err
+	}
+	if err := src.Rebuild(dst, cfg.Sync.BatchSize); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
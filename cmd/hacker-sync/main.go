@@ -1,31 +1,64 @@
 package main
 
 import (
-	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"os/signal"
 
-	"github.com/dan-mcdonald/fasthacker/internal/sync"
-	"github.com/dan-mcdonald/fasthacker/internal/web"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/dan-mcdonald/fasthacker/internal/config"
 )
 
-func main() {
-	fmt.Println("hacker-sync starting")
+const usage = `usage: hacker-sync [flags] [command]
+
+commands:
+  run          sync from upstream and serve the web UI (default)
+  sync         sync from upstream without the web UI
+  serve        serve the web UI from the event log, without syncing
+  get <id>     print an item; -thread prints its replies too
+  stats        summarize what the event log holds
+  vacuum       compact the event log file
+  train        train a new compression dictionary on recent items
+  replay <backend> <db>
+               rebuild another event log from a segments event log
+`
 
-	chInterrupt := make(chan os.Signal, 1)
-	signal.Notify(chInterrupt, os.Interrupt)
-	synk := sync.NewSync("hacker.db")
-	synk.Start(context.Background())
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		log.Println("starting metrics server http://localhost:9999/metrics")
-		log.Fatal(http.ListenAndServe("localhost:9999", nil))
-	}()
-	go web.Start(<-synk.EventStore())
-	<-chInterrupt
-	fmt.Println("interrupt received")
+func main() {
+	cfg, args, err := config.Load(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprint(os.Stderr, usage)
+		return
+	}
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	command := "run"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "run":
+		err = runSync(cfg, true)
+	case "sync":
+		err = runSync(cfg, false)
+	case "serve":
+		err = serve(cfg)
+	case "get":
+		err = get(cfg, args)
+	case "stats":
+		err = stats(cfg)
+	case "vacuum":
+		err = vacuum(cfg)
+	case "train":
+		err = train(cfg)
+	case "replay":
+		err = replay(cfg, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", command, err)
+	}
 }
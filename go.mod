@@ -11,9 +11,27 @@ require (
 	gorm.io/gorm v1.25.7
 )
 
-require github.com/avast/retry-go/v4 v4.5.1
+require (
+	github.com/avast/retry-go/v4 v4.5.1
+	github.com/jackc/pgx/v5 v5.5.4
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/time v0.5.0
+	gopkg.in/cenkalti/backoff.v1 v1.1.0
+	gopkg.in/yaml.v3 v3.0.1
+	gorm.io/driver/postgres v1.5.7
+)
 
-require google.golang.org/protobuf v1.32.0 // indirect
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
+	github.com/jackc/puddle/v2 v2.2.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	golang.org/x/crypto v0.19.0 // indirect
+	golang.org/x/sync v0.6.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
+)
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
@@ -29,5 +47,4 @@ require (
 	golang.org/x/exp v0.0.0-20240213143201-ec583247a57a // indirect
 	golang.org/x/net v0.21.0 // indirect
 	golang.org/x/sys v0.17.0 // indirect
-	gopkg.in/cenkalti/backoff.v1 v1.1.0 // indirect
 )
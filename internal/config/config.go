@@ -0,0 +1,160 @@
+package config
+
+// Configuration for hacker-sync. Settings are layered: built-in defaults,
+// then a YAML file, then FASTHACKER_* environment variables, then flags.
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/sync"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Sync    sync.Config `yaml:"sync"`
+	Web     Server      `yaml:"web"`
+	Metrics Server      `yaml:"metrics"`
+}
+
+type Server struct {
+	Addr string `yaml:"addr"`
+}
+
+func Default() Config {
+	return Config{
+		Sync:    sync.DefaultConfig(),
+		Web:     Server{Addr: "localhost:8080"},
+		Metrics: Server{Addr: "localhost:9999"},
+	}
+}
+
+func (c Config) Validate() error {
+	errs := []error{c.Sync.Validate()}
+	if _, _, err := net.SplitHostPort(c.Web.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("web.addr: %w", err))
+	}
+	if _, _, err := net.SplitHostPort(c.Metrics.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("metrics.addr: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// setting is one value that can come from the environment or a flag.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func setString(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setFloat(field func(c *Config) *float64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = f
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+var settings = []setting{
+	{"backend", "FASTHACKER_BACKEND", "event log backend: sqlite, memory, postgres or segments", setString(func(c *Config) *string { return (*string)(&c.Sync.Backend) })},
+	{"db", "FASTHACKER_DB", "SQLite event log path, Postgres connection string or segments directory", setString(func(c *Config) *string { return &c.Sync.DBPath })},
+	{"base-url", "FASTHACKER_BASE_URL", "root of the Hacker News API", setString(func(c *Config) *string { return &c.Sync.BaseURL })},
+	{"user-agent", "FASTHACKER_USER_AGENT", "User-Agent sent upstream", setString(func(c *Config) *string { return &c.Sync.UserAgent })},
+	{"from", "FASTHACKER_FROM", "contact address sent upstream in the From header", setString(func(c *Config) *string { return &c.Sync.From })},
+	{"workers", "FASTHACKER_WORKERS", "number of fetch workers", setInt(func(c *Config) *int { return &c.Sync.Workers })},
+	{"batch-size", "FASTHACKER_BATCH_SIZE", "events per event log write", setInt(func(c *Config) *int { return &c.Sync.BatchSize })},
+	{"rate", "FASTHACKER_RATE", "upstream requests per second", setFloat(func(c *Config) *float64 { return &c.Sync.Rate })},
+	{"burst", "FASTHACKER_BURST", "upstream requests allowed at once above the rate", setInt(func(c *Config) *int { return &c.Sync.Burst })},
+	{"poll-interval", "FASTHACKER_POLL_INTERVAL", "poll upstream this often instead of using SSE", setDuration(func(c *Config) *time.Duration { return &c.Sync.PollInterval })},
+	{"web-addr", "FASTHACKER_WEB_ADDR", "address the web server listens on", setString(func(c *Config) *string { return &c.Web.Addr })},
+	{"metrics-addr", "FASTHACKER_METRICS_ADDR", "address the metrics server listens on", setString(func(c *Config) *string { return &c.Metrics.Addr })},
+}
+
+// Load builds the config from a file named by -config or FASTHACKER_CONFIG,
+// the environment and the flags in args, and validates it. It returns the
+// arguments left after the flags.
+func Load(name string, args []string) (Config, []string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("FASTHACKER_CONFIG"), "path of a YAML config file")
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		fs.Func(s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env), func(value string) error {
+			flagValues[s.flag] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	c := Default()
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return Config{}, nil, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, nil, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(&c, value); err != nil {
+				return Config{}, nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if value, ok := flagValues[s.flag]; ok {
+			if err := s.set(&c, value); err != nil {
+				return Config{}, nil, fmt.Errorf("-%s: %w", s.flag, err)
+			}
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return Config{}, nil, err
+	}
+	return c, fs.Args(), nil
+}
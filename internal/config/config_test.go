@@ -0,0 +1,60 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hacker-sync.yaml")
+	err := os.WriteFile(path, []byte(`
+sync:
+  db: file.db
+  workers: 10
+  rate: 5
+  poll_interval: 30s
+web:
+  addr: localhost:8000
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FASTHACKER_WORKERS", "20")
+	t.Setenv("FASTHACKER_WEB_ADDR", "localhost:8001")
+	t.Setenv("FASTHACKER_BURST", "7")
+
+	c, args, err := Load("test", []string{"-config", path, "-web-addr", "localhost:8002", "serve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Sync.DBPath != "file.db" || c.Sync.Rate != 5 || c.Sync.PollInterval != 30*time.Second {
+		t.Errorf("file settings not applied: %+v", c.Sync)
+	}
+	if c.Sync.Workers != 20 {
+		t.Errorf("workers = %d, want the environment's 20", c.Sync.Workers)
+	}
+	if c.Sync.Burst != 7 {
+		t.Errorf("burst = %d, want the environment's 7", c.Sync.Burst)
+	}
+	if c.Web.Addr != "localhost:8002" {
+		t.Errorf("web addr = %s, want the flag's localhost:8002", c.Web.Addr)
+	}
+	if c.Metrics.Addr != Default().Metrics.Addr || c.Sync.BatchSize != Default().Sync.BatchSize {
+		t.Errorf("defaults not kept: %+v", c)
+	}
+	if len(args) != 1 || args[0] != "serve" {
+		t.Errorf("args = %v, want [serve]", args)
+	}
+}
+
+func TestLoadValidates(t *testing.T) {
+	_, _, err := Load("test", []string{"-workers", "0", "-rate", "0", "-metrics-addr", "nowhere", "-backend", "csv"})
+	for _, want := range []string{"workers", "rate", "metrics.addr", "backend"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Load = %v, want an error for %s", err, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package eventlog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+	"gorm.io/gorm"
+)
+
+// EventLog is where synced items, users and lists are stored. Every
+// implementation keeps each revision it is given, except that an item
+// revision byte-identical to the item's latest one is recorded only as an
+// observation.
+type EventLog interface {
+	Close() error
+
+	ItemIDRanges() ([]model.ItemIDRange, error)
+	// WriteItemBatch writes a batch of item revisions and the transitions
+	// found in them, all or nothing.
+	WriteItemBatch(updates []model.ItemUpdate, transitions []model.Transition) error
+	GetLatestItem(id model.ItemID) (*model.Item, error)
+	// GetItemAt returns the revision of an item that was latest at at, or
+	// ErrNotFound if it had not been received by then.
+	GetItemAt(id model.ItemID, at time.Time) (*model.Item, error)
+	LatestItems(ids []model.ItemID) (map[model.ItemID]*model.Item, error)
+	ItemObservedTimes(id model.ItemID) ([]time.Time, error)
+
+	WriteUserBatch(updates []model.UserUpdate) error
+	GetLatestUser(id model.UserID) (*model.User, error)
+
+	WriteList(listUpdate model.ListUpdate) error
+	GetList(name model.ListName) (*model.StoryList, error)
+	GetListAt(name model.ListName, at time.Time) (*model.StoryList, error)
+
+	GetFailedFetch(id model.ItemID) (*model.FailedFetch, error)
+	PutFailedFetch(f model.FailedFetch) error
+	DueFailedFetches(now time.Time, limit int) ([]model.FailedFetch, error)
+	FailedFetches() ([]model.FailedFetch, error)
+
+	// WriteTransitions writes transitions on their own, for copying them
+	// from another log.
+	WriteTransitions(transitions []model.Transition) error
+	GetTransitions(from, to time.Time) ([]model.Transition, error)
+}
+
+var (
+	_ EventLog = (*GormLog)(nil)
+	_ EventLog = (*MemoryLog)(nil)
+	_ EventLog = (*SegmentLog)(nil)
+)
+
+// ErrNotFound is returned when an item, user or list has never been stored.
+var ErrNotFound = gorm.ErrRecordNotFound
+
+// Backend names an EventLog implementation.
+type Backend string
+
+const (
+	BackendSQLite   Backend = "sqlite"
+	BackendMemory   Backend = "memory"
+	BackendPostgres Backend = "postgres"
+	BackendSegments Backend = "segments"
+)
+
+func (b Backend) Validate() error {
+	switch b {
+	case BackendSQLite, BackendMemory, BackendPostgres, BackendSegments:
+		return nil
+	}
+	return fmt.Errorf("unknown event log backend %q", b)
+}
+
+// Open opens the event log of the given backend. dsn is a file path for
+// SQLite, a connection string for Postgres, a directory for segments and
+// ignored for memory.
+func Open(backend Backend, dsn string) (EventLog, error) {
+	switch backend {
+	case BackendSQLite:
+		return NewEventLog(dsn)
+	case BackendMemory:
+		return NewMemoryLog(), nil
+	case BackendPostgres:
+		return NewPostgres(dsn)
+	case BackendSegments:
+		return OpenSegments(dsn)
+	}
+	return nil, backend.Validate()
+}
@@ -0,0 +1,179 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+// TestBackends runs the same checks against every backend. Postgres is only
+// tested when FASTHACKER_TEST_POSTGRES_DSN names a scratch database.
+func TestBackends(t *testing.T) {
+	backends := map[Backend]func(t *testing.T) string{
+		BackendSQLite:   func(t *testing.T) string { return filepath.Join(t.TempDir(), "test.db") },
+		BackendMemory:   func(t *testing.T) string { return "" },
+		BackendSegments: func(t *testing.T) string { return t.TempDir() },
+		BackendPostgres: func(t *testing.T) string {
+			dsn := os.Getenv("FASTHACKER_TEST_POSTGRES_DSN")
+			if dsn == "" {
+				t.Skip("FASTHACKER_TEST_POSTGRES_DSN not set")
+			}
+			return dsn
+		},
+	}
+	for backend, dsn := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			e, err := Open(backend, dsn(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close()
+			testEventLog(t, e)
+		})
+	}
+}
+
+func testEventLog(t *testing.T, e EventLog) {
+	// Postgres may hold rows from an earlier run, so work above them.
+	ranges, err := e.ItemIDRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := model.ItemID(0)
+	if len(ranges) > 0 {
+		base = ranges[len(ranges)-1].Hi + 10
+	}
+	t0 := time.Now().UTC().Truncate(time.Second)
+
+	if _, err := e.GetLatestItem(base + 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetLatestItem of unknown item: err = %v, want ErrNotFound", err)
+	}
+	item := func(id model.ItemID, title string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"id":%d,"type":"story","title":%q}`, id, title))
+	}
+	if err := e.PutFailedFetch(model.FailedFetch{ItemID: base + 2, Class: "timeout", Attempts: 1, NextRetryAt: t0}); err != nil {
+		t.Fatal(err)
+	}
+	updates := []model.ItemUpdate{
+		{RxTime: t0, ID: base + 1, Data: item(base+1, "a")},
+		{RxTime: t0, ID: base + 2, Data: item(base+2, "b")},
+		{RxTime: t0, ID: base + 4, Data: item(base+4, "d")},
+		{RxTime: t0.Add(time.Minute), ID: base + 1, Data: item(base+1, "a")},
+		{RxTime: t0.Add(2 * time.Minute), ID: base + 1, Data: item(base+1, "a2")},
+	}
+	transitions := []model.Transition{{ItemID: base + 1, Kind: model.TransitionTitleEdited, At: t0.Add(2 * time.Minute), Before: "a", After: "a2"}}
+	if err := e.WriteItemBatch(updates, transitions); err != nil {
+		t.Fatal(err)
+	}
+
+	ranges, err = e.ItemIDRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(ranges[len(ranges)-2:])
+	if want := fmt.Sprint([]model.ItemIDRange{{Lo: base + 1, Hi: base + 2}, {Lo: base + 4, Hi: base + 4}}); got != want {
+		t.Errorf("ItemIDRanges ends with %s, want %s", got, want)
+	}
+	latest, err := e.GetLatestItem(base + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Title == nil || *latest.Title != "a2" {
+		t.Errorf("latest title = %v, want a2", latest.Title)
+	}
+	for at, want := range map[time.Duration]string{90 * time.Second: "a", 2 * time.Minute: "a2"} {
+		item, err := e.GetItemAt(base+1, t0.Add(at))
+		if err != nil || item.Title == nil || *item.Title != want {
+			t.Errorf("GetItemAt(t0+%v) = %v, %v, want title %s", at, item, err, want)
+		}
+	}
+	if _, err := e.GetItemAt(base+1, t0.Add(-time.Second)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetItemAt before the first revision: err = %v, want ErrNotFound", err)
+	}
+	// Revisions and times with fractional seconds, and times in a zone ahead
+	// of UTC, compare as instants.
+	cest := time.FixedZone("CEST", 2*60*60)
+	updates = []model.ItemUpdate{
+		{RxTime: t0.Add(time.Second), ID: base + 5, Data: item(base+5, "e")},
+		{RxTime: t0.Add(1500 * time.Millisecond).In(cest), ID: base + 5, Data: item(base+5, "e2")},
+		{RxTime: t0.Add(2 * time.Second), ID: base + 5, Data: item(base+5, "e3")},
+	}
+	if err := e.WriteItemBatch(updates, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		at   time.Time
+		want string
+	}{
+		{t0.Add(1250 * time.Millisecond), "e"},
+		{t0.Add(1750 * time.Millisecond), "e2"},
+		{t0.Add(1250 * time.Millisecond).In(cest), "e"},
+		{t0.Add(1500 * time.Millisecond), "e2"},
+		{t0.Add(2 * time.Second).In(cest), "e3"},
+	} {
+		item, err := e.GetItemAt(base+5, c.at)
+		if err != nil || item.Title == nil || *item.Title != c.want {
+			t.Errorf("GetItemAt(%v) = %v, %v, want title %s", c.at, item, err, c.want)
+		}
+	}
+	if _, err := e.GetItemAt(base+5, t0.Add(999*time.Millisecond).In(cest)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetItemAt before the first revision, ahead of UTC: err = %v, want ErrNotFound", err)
+	}
+	items, err := e.LatestItems([]model.ItemID{base + 1, base + 3, base + 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[base+4] == nil {
+		t.Errorf("LatestItems = %v, want items %d and %d", items, base+1, base+4)
+	}
+	times, err := e.ItemObservedTimes(base + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 3 {
+		t.Errorf("observed %d times, want 3", len(times))
+	}
+	if f, err := e.GetFailedFetch(base + 2); err != nil || f != nil {
+		t.Errorf("GetFailedFetch after write = %v, %v, want nil", f, err)
+	}
+
+	if err := e.WriteList(model.ListUpdate{RxTime: t0, ID: model.ListTop, Data: json.RawMessage(fmt.Sprintf("[%d,%d]", base+2, base+1))}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := e.GetList(model.ListTop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprint([]model.ItemID{base + 2, base + 1}); fmt.Sprint(*list) != want {
+		t.Errorf("top list = %v, want %s", *list, want)
+	}
+
+	if err := e.WriteList(model.ListUpdate{RxTime: t0.Add(time.Hour), ID: model.ListTop, Data: json.RawMessage(fmt.Sprintf("[%d]", base+4))}); err != nil {
+		t.Fatal(err)
+	}
+	list, err = e.GetListAt(model.ListTop, t0.Add(30*time.Minute).In(cest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprint([]model.ItemID{base + 2, base + 1}); fmt.Sprint(*list) != want {
+		t.Errorf("top list at t0+30m = %v, want %s", *list, want)
+	}
+
+	copied := model.Transition{ItemID: base + 4, Kind: model.TransitionDeleted, At: t0.Add(150 * time.Second)}
+	if err := e.WriteTransitions([]model.Transition{copied}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := e.GetTransitions(t0, t0.Add(3*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].ItemID != base+1 || found[0].After != "a2" || found[1].ItemID != base+4 {
+		t.Errorf("GetTransitions = %v, want %v then %v", found, transitions[0], copied)
+	}
+}
@@ -0,0 +1,236 @@
+package eventlog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"gorm.io/gorm"
+)
+
+// dictionary is a zstd dictionary trained on stored item JSON. Payloads
+// record the version they were compressed with in their dict column: NULL
+// for raw JSON, 0 for zstd without a dictionary. Every version is kept so
+// old payloads stay readable. Until the first dictionary is trained payloads
+// are stored raw, so that Recompress later gives them the dictionary.
+type dictionary struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Data      []byte
+	Samples   int
+	CreatedAt time.Time
+}
+
+const (
+	// dictIDBase keeps our dictionary IDs out of the range zstd reserves
+	// for registered dictionaries.
+	dictIDBase = 1 << 15
+	// dictSamples is how many recent item revisions a dictionary is
+	// trained on, and dictMinSamples how many must be stored before the
+	// first one is trained.
+	dictSamples    = 10000
+	dictMinSamples = 1000
+	// dictHistorySize is the size of the content part of a dictionary.
+	dictHistorySize = 64 << 10
+)
+
+// codec compresses payloads with the newest dictionary and decompresses
+// them with any. Without a dictionary it has no encoder.
+type codec struct {
+	version int
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newCodec(dicts []dictionary) (*codec, error) {
+	raw := make([][]byte, len(dicts))
+	for i, d := range dicts {
+		raw[i] = d.Data
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(raw...))
+	if err != nil {
+		return nil, err
+	}
+	c := &codec{decoder: decoder}
+	if len(dicts) == 0 {
+		return c, nil
+	}
+	newest := dicts[len(dicts)-1]
+	c.version = newest.Version
+	if c.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderDict(newest.Data)); err != nil {
+		decoder.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func loadCodec(db *gorm.DB) (*codec, error) {
+	var dicts []dictionary
+	if err := db.Order("version").Find(&dicts).Error; err != nil {
+		return nil, err
+	}
+	return newCodec(dicts)
+}
+
+func (c *codec) close() {
+	c.decoder.Close()
+}
+
+// reloadCodec replaces the codec with one holding every stored dictionary.
+func (e *GormLog) reloadCodec() error {
+	c, err := loadCodec(e.db)
+	if err != nil {
+		return err
+	}
+	e.codec.close()
+	e.codec = c
+	return nil
+}
+
+// decompress returns the JSON of a payload. A payload compressed with a
+// dictionary newer than the codec's, trained by another process since the
+// log was opened, reloads the dictionaries first.
+func (e *GormLog) decompress(data []byte, dict *int) ([]byte, error) {
+	if dict != nil && *dict > e.codec.version {
+		if err := e.reloadCodec(); err != nil {
+			return nil, err
+		}
+	}
+	return e.codec.decompress(data, dict)
+}
+
+// compress returns data compressed and the dict column value to store with
+// it. nil stays nil, and without a dictionary data is returned raw.
+func (c *codec) compress(data []byte) ([]byte, *int) {
+	if data == nil || c.encoder == nil {
+		return data, nil
+	}
+	version := c.version
+	return c.encoder.EncodeAll(data, nil), &version
+}
+
+// decompress returns the JSON of a payload stored with the dict column
+// value dict.
+func (c *codec) decompress(data []byte, dict *int) ([]byte, error) {
+	if dict == nil || data == nil {
+		return data, nil
+	}
+	return c.decoder.DecodeAll(data, nil)
+}
+
+// TrainDictionary trains a new dictionary version on the most recent item
+// revisions and compresses new payloads with it from then on.
+func (e *GormLog) TrainDictionary() (int, error) {
+	var events []itemEvent
+	if err := e.db.Select("data", "dict").Order("id DESC").Limit(dictSamples).Find(&events).Error; err != nil {
+		return 0, err
+	}
+	if len(events) < dictMinSamples {
+		return 0, fmt.Errorf("%d item revisions stored, need %d to train a dictionary", len(events), dictMinSamples)
+	}
+	samples := make([][]byte, len(events))
+	var history []byte
+	for i, event := range events {
+		data, err := e.decompress(event.Data, event.Dict)
+		if err != nil {
+			return 0, err
+		}
+		samples[i] = data
+		if len(history)+len(data) <= dictHistorySize {
+			history = append(history, data...)
+		}
+	}
+	version := e.codec.version + 1
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       uint32(dictIDBase + version),
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := e.db.Create(&dictionary{Version: version, Data: dict, Samples: len(samples), CreatedAt: time.Now()}).Error; err != nil {
+		return 0, err
+	}
+	if err := e.reloadCodec(); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Recompressor is an EventLog that can compress payloads stored raw, from
+// before compression was added or before the first dictionary was trained.
+type Recompressor interface {
+	Recompress(limit int) (n int, done bool, err error)
+}
+
+// recompressTables are the tables holding payloads, by primary key.
+var recompressTables = []struct {
+	table string
+	key   string
+}{
+	{"item_events", "id"},
+	{"list_events", "id"},
+	{"current_items", "item_id"},
+}
+
+// Recompress compresses up to limit payloads still stored as raw JSON and
+// returns how many it compressed. It trains the first dictionary once
+// enough item revisions are stored, and compresses nothing before then.
+// Each call resumes where the last left off, reading raw rows through the
+// partial indexes of migration 11.
+//
+// Once a dictionary is trained new payloads are always written compressed,
+// so a call that finds no raw rows left then has nothing more to do, and
+// reports done.
+func (e *GormLog) Recompress(limit int) (int, bool, error) {
+	if e.codec.version == 0 {
+		var stored int64
+		if err := e.db.Raw("SELECT COUNT(*) FROM (SELECT 1 FROM item_events LIMIT ?) AS recent", dictMinSamples).Scan(&stored).Error; err != nil {
+			return 0, false, err
+		}
+		if stored >= dictMinSamples {
+			version, err := e.TrainDictionary()
+			if err != nil {
+				return 0, false, err
+			}
+			fmt.Printf("eventlog: trained dictionary version %d\n", version)
+		}
+	}
+	if e.codec.version == 0 {
+		return 0, false, nil
+	}
+	n := 0
+	for _, t := range recompressTables {
+		if n >= limit {
+			break
+		}
+		var rows []struct {
+			RowKey int64
+			Data   []byte
+		}
+		err := e.db.Raw(fmt.Sprintf("SELECT %[2]s AS row_key, data FROM %[1]s WHERE %[2]s > ? AND dict IS NULL AND data IS NOT NULL ORDER BY %[2]s LIMIT ?", t.table, t.key),
+			e.recompressed[t.table], limit-n).Scan(&rows).Error
+		if err != nil {
+			return n, false, err
+		}
+		err = e.db.Transaction(func(tx *gorm.DB) error {
+			for _, row := range rows {
+				data, dict := e.codec.compress(row.Data)
+				if err := tx.Exec(fmt.Sprintf("UPDATE %s SET data = ?, dict = ? WHERE %s = ?", t.table, t.key), data, dict, row.RowKey).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return n, false, err
+		}
+		if len(rows) > 0 {
+			e.recompressed[t.table] = rows[len(rows)-1].RowKey
+		}
+		n += len(rows)
+	}
+	return n, n == 0, nil
+}
@@ -0,0 +1,193 @@
+package eventlog
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+func TestRecompress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	e, err := NewEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	itemJSON := func(id int) []byte {
+		return []byte(fmt.Sprintf(`{"by":"user%d","id":%d,"kids":[%d,%d],"parent":%d,"text":"Comment number %d, which says much the same as its neighbours.","time":%d,"type":"comment"}`,
+			id%37, id, id+1, id+2, id/2, id, t0.Unix()+int64(id)))
+	}
+	// Rows from before compression was added hold raw JSON.
+	var raw []itemEvent
+	for id := 1; id <= dictMinSamples; id++ {
+		raw = append(raw, itemEvent{RxTime: t0, ItemID: model.ItemID(id), Data: itemJSON(id)})
+	}
+	if err := e.db.CreateInBatches(raw, 100).Error; err != nil {
+		t.Fatal(err)
+	}
+	var current []currentItem
+	for _, event := range raw {
+		sum := sha256.Sum256(event.Data)
+		current = append(current, toCurrentItem(event.ItemID, event.RxTime, event.Data, sum[:]))
+	}
+	if err := e.db.CreateInBatches(current, 100).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteList(model.ListUpdate{RxTime: t0, ID: model.ListTop, Data: json.RawMessage("[3,2,1]")}); err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for {
+		n, done, err := e.Recompress(300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done {
+			break
+		}
+		total += n
+	}
+	// every item revision, its current item and the list
+	if want := 2*dictMinSamples + 1; total != want {
+		t.Errorf("recompressed %d payloads, want %d", total, want)
+	}
+	if e.codec.version != 1 {
+		t.Errorf("dictionary version %d, want 1", e.codec.version)
+	}
+	var left int64
+	if err := e.db.Model(&itemEvent{}).Where("dict IS NULL").Count(&left).Error; err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d item events left uncompressed", left)
+	}
+	var stored itemEvent
+	if err := e.db.Where("item_id = ?", 500).Take(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Data) >= len(itemJSON(500))/2 {
+		t.Errorf("compressed to %d bytes from %d", len(stored.Data), len(itemJSON(500)))
+	}
+	// Written with the dictionary, and still deduplicated against the
+	// recompressed revision.
+	err = e.WriteItemBatch([]model.ItemUpdate{
+		{RxTime: t0.Add(time.Minute), ID: 500, Data: itemJSON(500)},
+		{RxTime: t0.Add(time.Minute), ID: 2000, Data: itemJSON(2000)},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	e, err = NewEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var revisions int64
+	if err := e.db.Model(&itemEvent{}).Where("item_id = ?", 500).Count(&revisions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if revisions != 1 {
+		t.Errorf("item 500 has %d revisions, want 1", revisions)
+	}
+	for _, id := range []model.ItemID{500, 2000} {
+		item, err := e.GetLatestItem(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.ID != id || item.Parent == nil || *item.Parent != id/2 {
+			t.Errorf("GetLatestItem(%d) = %+v", id, item)
+		}
+	}
+	list, err := e.GetList(model.ListTop)
+	if err != nil || len(*list) != 3 {
+		t.Errorf("GetList = %v, %v", list, err)
+	}
+}
+
+func TestDictionaryTrainedElsewhere(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	writer, err := NewEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	// Nothing is raw, but the first dictionary is still to be trained.
+	if _, done, err := writer.Recompress(100); err != nil || done {
+		t.Errorf("Recompress on an empty log = done %v, %v, want not done", done, err)
+	}
+	reader, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var updates []model.ItemUpdate
+	for id := 1; id <= dictMinSamples+1; id++ {
+		data := fmt.Sprintf(`{"by":"user%d","id":%d,"text":"Comment number %d.","type":"comment"}`, id%37, id, id)
+		updates = append(updates, model.ItemUpdate{RxTime: t0, ID: model.ItemID(id), Data: json.RawMessage(data)})
+	}
+	if err := writer.WriteItemBatch(updates[:dictMinSamples], nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.TrainDictionary(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteItemBatch(updates[dictMinSamples:], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reader loaded no dictionaries, so it has to reload them.
+	item, err := reader.GetLatestItem(dictMinSamples + 1)
+	if err != nil || item.ID != dictMinSamples+1 {
+		t.Errorf("GetLatestItem = %v, %v", item, err)
+	}
+}
+
+func TestFirstDictionaryReachesEarlierRows(t *testing.T) {
+	e, err := NewEventLog(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	// The initial sync of a new mirror, written before any dictionary.
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var updates []model.ItemUpdate
+	for id := 1; id <= dictMinSamples; id++ {
+		data := fmt.Sprintf(`{"by":"user%d","id":%d,"text":"Comment number %d.","type":"comment"}`, id%37, id, id)
+		updates = append(updates, model.ItemUpdate{RxTime: t0, ID: model.ItemID(id), Data: json.RawMessage(data)})
+	}
+	if err := e.WriteItemBatch(updates, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteList(model.ListUpdate{RxTime: t0, ID: model.ListTop, Data: json.RawMessage("[3,2,1]")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for done := false; !done; {
+		if _, done, err = e.Recompress(300); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, table := range []string{"item_events", "list_events", "current_items"} {
+		var left int64
+		if err := e.db.Table(table).Where("dict IS NULL OR dict = 0").Count(&left).Error; err != nil {
+			t.Fatal(err)
+		}
+		if left != 0 {
+			t.Errorf("%d %s rows without the dictionary", left, table)
+		}
+	}
+	item, err := e.GetLatestItem(dictMinSamples)
+	if err != nil || item.ID != dictMinSamples {
+		t.Errorf("GetLatestItem = %v, %v", item, err)
+	}
+}
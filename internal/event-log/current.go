@@ -0,0 +1,67 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// currentItem is the latest revision of an item, kept up to date by
+// WriteItemBatch, with the fields pages filter and sort on pulled out of
+// its JSON and indexed. Data, Dict and Hash are the revision's, so reading or
+// deduplicating against the latest revision is a primary key lookup; a whole
+// item is still decoded from Data, since text, kids and parts are not
+// pulled out.
+type currentItem struct {
+	ItemID      model.ItemID `gorm:"primaryKey;autoIncrement:false"`
+	RxTime      time.Time
+	Type        string        `gorm:"index"`
+	By          *model.UserID `gorm:"index"`
+	Time        time.Time     `gorm:"index"`
+	Parent      *model.ItemID `gorm:"index"`
+	Score       *int          `gorm:"index"`
+	Descendants *int          `gorm:"index"`
+	Title       *string       `gorm:"index"`
+	URL         *string
+	Dead        bool `gorm:"index"`
+	Deleted     bool `gorm:"index"`
+	Data        []byte
+	Dict        *int
+	Hash        []byte
+}
+
+// toCurrentItem extracts the columns of a revision. A revision that does not
+// decode keeps only its data; reading it fails as it would from item_events.
+func toCurrentItem(id model.ItemID, rxTime time.Time, data, hash []byte) currentItem {
+	current := currentItem{ItemID: id, RxTime: rxTime, Data: data, Hash: hash}
+	var item model.Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return current
+	}
+	current.Type = item.Type
+	current.By = item.By
+	current.Time = item.Time.Time
+	current.Parent = item.Parent
+	current.Score = item.Score
+	current.Descendants = item.Descendants
+	current.Title = item.Title
+	current.URL = item.URL
+	current.Dead = item.Dead != nil && *item.Dead
+	current.Deleted = item.Deleted != nil && *item.Deleted
+	return current
+}
+
+// upsertCurrentItems replaces the current row of each item with the given
+// one. Callers pass only revisions newer than the stored ones.
+func upsertCurrentItems(tx *gorm.DB, items []currentItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "item_id"}},
+		UpdateAll: true,
+	}).Create(items).Error
+}
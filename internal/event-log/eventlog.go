@@ -1,17 +1,16 @@
+// Package eventlog stores every revision of the items, users and lists
+// fetched from upstream. GormLog keeps them in SQLite or Postgres, SegmentLog
+// in append-only JSONL files and MemoryLog in memory for tests.
 package eventlog
 
-// Interface for reading and writing events to a CSV log
-// The CSV log has the following format:
-// unix_nanoseconds, event_type, data
-// The CSV log is append-only
-// The CSV log is not thread-safe
-
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/dan-mcdonald/fasthacker/internal/model"
@@ -33,19 +32,81 @@ type itemEvent struct {
 	RxTime time.Time    `gorm:"uniqueIndex:idx_itemid_rxtime,priority:2"`
 	ItemID model.ItemID `gorm:"uniqueIndex:idx_itemid_rxtime,priority:1"`
 	Data   []byte
+	// Dict is how Data is compressed; see dictionary.
+	Dict *int
+	// Hash is the SHA-256 of the uncompressed Data. Rows written before
+	// hashing was added have none.
+	Hash []byte
+}
+
+// itemObservation records that an item was fetched at RxTime and found
+// byte-identical to its latest stored revision.
+type itemObservation struct {
+	ID     uint64       `gorm:"primaryKey;autoIncrement:true"`
+	RxTime time.Time    `gorm:"uniqueIndex:idx_observation_itemid_rxtime,priority:2"`
+	ItemID model.ItemID `gorm:"uniqueIndex:idx_observation_itemid_rxtime,priority:1"`
 }
 
-type topStoriesEvent struct {
-	ID     uint64    `gorm:"primaryKey;autoIncrement:true"`
-	RxTime time.Time `gorm:"uniqueIndex:idx_rxtime"`
+type userEvent struct {
+	ID     uint64       `gorm:"primaryKey;autoIncrement:true"`
+	RxTime time.Time    `gorm:"uniqueIndex:idx_userid_rxtime,priority:2"`
+	UserID model.UserID `gorm:"uniqueIndex:idx_userid_rxtime,priority:1"`
 	Data   []byte
 }
 
-type EventLog struct {
-	db *gorm.DB
+type listEvent struct {
+	ID     uint64         `gorm:"primaryKey;autoIncrement:true"`
+	RxTime time.Time      `gorm:"uniqueIndex:idx_list_rxtime,priority:2"`
+	List   model.ListName `gorm:"uniqueIndex:idx_list_rxtime,priority:1"`
+	Data   []byte
+	Dict   *int
+}
+
+// failedFetch is the dead-letter table for items that could not be fetched.
+// A row is removed once the item is written successfully.
+type failedFetch struct {
+	ItemID        model.ItemID `gorm:"primaryKey;autoIncrement:false"`
+	Class         string
+	Attempts      int
+	LastError     string
+	FirstFailedAt time.Time
+	LastFailedAt  time.Time
+	NextRetryAt   time.Time `gorm:"index"`
+}
+
+// transitionEvent is a change between two revisions of an item, found by
+// the sync layer when the newer one is written.
+type transitionEvent struct {
+	ID     uint64       `gorm:"primaryKey;autoIncrement:true"`
+	At     time.Time    `gorm:"index"`
+	ItemID model.ItemID `gorm:"index"`
+	Kind   model.TransitionKind
+	Before string
+	After  string
+}
+
+// GormLog is an EventLog kept in a SQL database through gorm.
+type GormLog struct {
+	db    *gorm.DB
+	codec *codec
+	// recompressed is how far Recompress has got through each table.
+	recompressed map[string]int64
 }
 
-func (e *EventLog) Close() error {
+func newGormLog(db *gorm.DB) (*GormLog, error) {
+	c, err := loadCodec(db)
+	if err != nil {
+		return nil, err
+	}
+	return &GormLog{
+		db:           db,
+		codec:        c,
+		recompressed: make(map[string]int64),
+	}, nil
+}
+
+func (e *GormLog) Close() error {
+	e.codec.close()
 	db, err := e.db.DB()
 	if err != nil {
 		return err
@@ -53,8 +114,16 @@ func (e *EventLog) Close() error {
 	return db.Close()
 }
 
-// NewEventLog creates a new event log
-func NewEventLog(path string) (*EventLog, error) {
+// open opens the SQLite database at path with query parameters params.
+// Times are stored as integer Unix nanoseconds, which compare and sort as
+// instants, unlike the RFC 3339 text the driver writes by default.
+func open(path string, params ...string) (*gorm.DB, error) {
+	escaped := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+	dsn := "file:" + escaped + "?" + strings.Join(append([]string{"_timefmt=unixepoch_nano"}, params...), "&")
+	return openDialector(gormlite.Open(dsn))
+}
+
+func openDialector(dialector gorm.Dialector) (*gorm.DB, error) {
 	logger := logger.New(
 		log.New(os.Stdout, "\n", log.LstdFlags),
 		logger.Config{
@@ -63,93 +132,505 @@ func NewEventLog(path string) (*EventLog, error) {
 			Colorful:      true,
 		},
 	)
-	db, err := gorm.Open(gormlite.Open(path), &gorm.Config{
+	return gorm.Open(dialector, &gorm.Config{
 		Logger: logger,
 	})
+}
+
+// OpenReadOnly opens an existing event log without migrating it. Every
+// write through it fails, so it is safe to point at a copied database.
+func OpenReadOnly(path string) (*GormLog, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := open(path, "mode=ro")
 	if err != nil {
 		return nil, err
 	}
-
-	fmt.Println("eventlog: migration start")
-	migrator := db.Debug().Migrator()
-	if !migrator.HasTable(&itemEvent{}) {
-		if err := migrator.CreateTable(&itemEvent{}); err != nil {
-			return nil, err
+	if err := checkReadable(db, path); err != nil {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
 		}
+		return nil, err
 	}
-	if !migrator.HasTable(&topStoriesEvent{}) {
-		if err := migrator.CreateTable(&topStoriesEvent{}); err != nil {
-			return nil, err
-		}
+	return newGormLog(db)
+}
+
+// checkReadable fails unless db holds an event log at exactly the schema
+// version of this build, which is what reading it without migrating needs.
+func checkReadable(db *gorm.DB, name string) error {
+	if !db.Migrator().HasTable(&itemEvent{}) {
+		return fmt.Errorf("%s is not an event log", name)
 	}
-	fmt.Println("eventlog: migration complete")
+	version, err := checkSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version < SchemaVersion {
+		return fmt.Errorf("%s is at schema version %d, want %d; open it read-write once to migrate it", name, version, SchemaVersion)
+	}
+	return nil
+}
 
-	return &EventLog{
-		db: db,
-	}, nil
+// NewEventLog opens the SQLite event log at path, creating and migrating it
+// as needed.
+func NewEventLog(path string) (*GormLog, error) {
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		return nil, err
+	}
+	return newGormLog(db)
 }
 
-func (e *EventLog) ItemIDs() []model.ItemID {
+// ItemIDRanges returns the stored item IDs as sorted runs of consecutive
+// IDs, computed in one pass over the item_id index.
+func (e *GormLog) ItemIDRanges() ([]model.ItemIDRange, error) {
 	startTime := time.Now()
 	defer func() {
-		fmt.Printf("eventlog.ItemIDs took %v\n", time.Since(startTime))
+		fmt.Printf("eventlog.ItemIDRanges took %v\n", time.Since(startTime))
 	}()
-	var itemIDs []model.ItemID
-	tx := e.db.Model(&itemEvent{}).Pluck("item_id", &itemIDs)
+	var ranges []model.ItemIDRange
+	tx := e.db.Raw(`SELECT MIN(item_id) AS lo, MAX(item_id) AS hi
+		FROM (
+			SELECT item_id, item_id - ROW_NUMBER() OVER (ORDER BY item_id) AS grp
+			FROM (SELECT DISTINCT item_id FROM item_events) AS ids
+		) AS runs
+		GROUP BY grp
+		ORDER BY lo`).Scan(&ranges)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return ranges, nil
+}
+
+// latestItemHeads returns the receive time and hash of the latest stored
+// revision of each of ids that has one.
+func latestItemHeads(tx *gorm.DB, ids []model.ItemID) (map[model.ItemID]currentItem, error) {
+	var rows []currentItem
+	if err := tx.Select("item_id", "rx_time", "hash").Where("item_id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	heads := make(map[model.ItemID]currentItem, len(rows))
+	for _, row := range rows {
+		heads[row.ItemID] = row
+	}
+	return heads, nil
+}
+
+// WriteItemBatch writes a batch of item events and their transitions to the
+// log in one transaction and brings current_items up to date. A revision
+// byte-identical to the item's latest one is recorded only as an
+// observation.
+func (e *GormLog) WriteItemBatch(updates []model.ItemUpdate, transitions []model.Transition) error {
+	itemIDs := make([]model.ItemID, len(updates))
+	for i, update := range updates {
+		itemIDs[i] = update.ID
+	}
+	return e.db.Transaction(func(tx *gorm.DB) error {
+		stored, err := latestItemHeads(tx, itemIDs)
+		if err != nil {
+			return err
+		}
+		latest := make(map[model.ItemID][]byte, len(stored))
+		for id, head := range stored {
+			latest[id] = head.Hash
+		}
+		var events []itemEvent
+		var observations []itemObservation
+		current := make(map[model.ItemID]currentItem)
+		for _, update := range updates {
+			sum := sha256.Sum256(update.Data)
+			if bytes.Equal(latest[update.ID], sum[:]) {
+				observations = append(observations, itemObservation{
+					RxTime: update.RxTime,
+					ItemID: update.ID,
+				})
+				continue
+			}
+			latest[update.ID] = sum[:]
+			data, dict := e.codec.compress(update.Data)
+			events = append(events, itemEvent{
+				RxTime: update.RxTime,
+				ItemID: update.ID,
+				Data:   data,
+				Dict:   dict,
+				Hash:   sum[:],
+			})
+			if head, ok := stored[update.ID]; ok && update.RxTime.Before(head.RxTime) {
+				continue
+			}
+			if prev, ok := current[update.ID]; !ok || !update.RxTime.Before(prev.RxTime) {
+				item := toCurrentItem(update.ID, update.RxTime, update.Data, sum[:])
+				item.Data, item.Dict = data, dict
+				current[update.ID] = item
+			}
+		}
+		if len(events) > 0 {
+			if err := tx.Create(events).Error; err != nil {
+				return err
+			}
+		}
+		currentItems := make([]currentItem, 0, len(current))
+		for _, item := range current {
+			currentItems = append(currentItems, item)
+		}
+		if err := upsertCurrentItems(tx, currentItems); err != nil {
+			return err
+		}
+		if len(observations) > 0 {
+			if err := tx.Create(observations).Error; err != nil {
+				return err
+			}
+		}
+		if len(transitions) > 0 {
+			if err := tx.Create(toTransitionEvents(transitions)).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("item_id IN ?", itemIDs).Delete(&failedFetch{}).Error
+	})
+}
+
+// LatestItems returns the latest stored revision of each of ids that has
+// one.
+func (e *GormLog) LatestItems(ids []model.ItemID) (map[model.ItemID]*model.Item, error) {
+	var rows []currentItem
+	if err := e.db.Select("item_id", "data", "dict").Where("item_id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	items := make(map[model.ItemID]*model.Item, len(rows))
+	for _, row := range rows {
+		data, err := e.decompress(row.Data, row.Dict)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %w", row.ItemID, err)
+		}
+		var item model.Item
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, fmt.Errorf("item %d: %w", row.ItemID, err)
+		}
+		items[row.ItemID] = &item
+	}
+	return items, nil
+}
+
+// ItemObservedTimes returns every time an item was fetched, whether or not
+// it had changed, oldest first.
+func (e *GormLog) ItemObservedTimes(id model.ItemID) ([]time.Time, error) {
+	var times []time.Time
+	tx := e.db.Raw(`SELECT rx_time FROM item_events WHERE item_id = ?
+		UNION ALL
+		SELECT rx_time FROM item_observations WHERE item_id = ?
+		ORDER BY rx_time`, id, id).Scan(&times)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return times, nil
+}
+
+func (e *GormLog) GetLatestItem(id model.ItemID) (*model.Item, error) {
+	var current currentItem
+	tx := e.db.Select("data", "dict").Where("item_id = ?", id).Take(&current)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	data, err := e.decompress(current.Data, current.Dict)
+	if err != nil {
+		return nil, err
+	}
+	jsonDecoder := json.NewDecoder(bytes.NewReader(data))
+	var item model.Item
+	if err := jsonDecoder.Decode(&item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// GetItemAt returns an item as last received at or before at.
+func (e *GormLog) GetItemAt(id model.ItemID, at time.Time) (*model.Item, error) {
+	var event itemEvent
+	tx := e.db.Select("data", "dict").Where("item_id = ? AND rx_time <= ?", id, at.UTC()).Order("rx_time DESC").First(&event)
 	if tx.Error != nil {
-		log.Fatalf("eventlog.ItemIDs: error reading item IDs: %v\n", tx.Error)
+		return nil, tx.Error
+	}
+	data, err := e.decompress(event.Data, event.Dict)
+	if err != nil {
+		return nil, err
+	}
+	var item model.Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
 	}
-	return itemIDs
+	return &item, nil
 }
 
-// WriteItemBatch an item event to the log
-func (e *EventLog) WriteItemBatch(updates []model.ItemUpdate) error {
-	events := make([]itemEvent, len(updates))
+// WriteUserBatch writes a batch of user profile events to the log
+func (e *GormLog) WriteUserBatch(updates []model.UserUpdate) error {
+	events := make([]userEvent, len(updates))
 	for i, update := range updates {
-		events[i] = itemEvent{
+		events[i] = userEvent{
 			RxTime: update.RxTime,
-			ItemID: update.ID,
+			UserID: update.ID,
 			Data:   update.Data,
 		}
 	}
 	return e.db.Create(events).Error
 }
 
-func (e *EventLog) GetLatestItem(id model.ItemID) (*model.Item, error) {
-	var event itemEvent
-	tx := e.db.Where("item_id = ?", id).Order("rx_time DESC").First(&event)
+func (e *GormLog) GetLatestUser(id model.UserID) (*model.User, error) {
+	var event userEvent
+	tx := e.db.Where("user_id = ?", id).Order("rx_time DESC").First(&event)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
 	jsonDecoder := json.NewDecoder(bytes.NewReader(event.Data))
-	var item model.Item
-	if err := jsonDecoder.Decode(&item); err != nil {
+	var user model.User
+	if err := jsonDecoder.Decode(&user); err != nil {
 		return nil, err
 	}
-	return &item, nil
+	return &user, nil
 }
 
-func (e *EventLog) WriteTopStories(topStoriesUpdate model.TopStoriesUpdate) error {
-	event := topStoriesEvent{
-		RxTime: topStoriesUpdate.RxTime,
-		Data:   topStoriesUpdate.Data,
+func (e *GormLog) WriteList(listUpdate model.ListUpdate) error {
+	data, dict := e.codec.compress(listUpdate.Data)
+	event := listEvent{
+		RxTime: listUpdate.RxTime,
+		List:   listUpdate.ID,
+		Data:   data,
+		Dict:   dict,
 	}
 	return e.db.Create(&event).Error
 }
 
-func (e *EventLog) GetTopStories() (*model.TopStories, error) {
-	var event topStoriesEvent
-	tx := e.db.Order("rx_time DESC").First(&event)
+func (e *GormLog) GetList(name model.ListName) (*model.StoryList, error) {
+	var event listEvent
+	tx := e.db.Where("list = ?", name).Order("rx_time DESC").First(&event)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
+	return e.decodeList(event)
+}
+
+// GetListAt returns a list as last received at or before at.
+func (e *GormLog) GetListAt(name model.ListName, at time.Time) (*model.StoryList, error) {
+	var event listEvent
+	tx := e.db.Where("list = ? AND rx_time <= ?", name, at.UTC()).Order("rx_time DESC").First(&event)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return e.decodeList(event)
+}
+
+func (e *GormLog) decodeList(event listEvent) (*model.StoryList, error) {
 	if event.Data == nil {
 		return nil, nil
 	}
-	var topStories model.TopStories
-	jsonDecoder := json.NewDecoder(bytes.NewReader(event.Data))
-	if err := jsonDecoder.Decode(&topStories); err != nil {
+	data, err := e.decompress(event.Data, event.Dict)
+	if err != nil {
+		return nil, err
+	}
+	var list model.StoryList
+	jsonDecoder := json.NewDecoder(bytes.NewReader(data))
+	if err := jsonDecoder.Decode(&list); err != nil {
 		return nil, err
 	}
-	return &topStories, nil
+	return &list, nil
+}
+
+func toFailedFetch(f failedFetch) model.FailedFetch {
+	return model.FailedFetch{
+		ItemID:        f.ItemID,
+		Class:         f.Class,
+		Attempts:      f.Attempts,
+		LastError:     f.LastError,
+		FirstFailedAt: f.FirstFailedAt,
+		LastFailedAt:  f.LastFailedAt,
+		NextRetryAt:   f.NextRetryAt,
+	}
+}
+
+// GetFailedFetch returns the dead-letter entry for an item, or nil if the
+// item has not failed.
+func (e *GormLog) GetFailedFetch(id model.ItemID) (*model.FailedFetch, error) {
+	var rows []failedFetch
+	if err := e.db.Where("item_id = ?", id).Limit(1).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	f := toFailedFetch(rows[0])
+	return &f, nil
+}
+
+// PutFailedFetch inserts or replaces the dead-letter entry for an item.
+func (e *GormLog) PutFailedFetch(f model.FailedFetch) error {
+	return e.db.Save(&failedFetch{
+		ItemID:        f.ItemID,
+		Class:         f.Class,
+		Attempts:      f.Attempts,
+		LastError:     f.LastError,
+		FirstFailedAt: f.FirstFailedAt,
+		LastFailedAt:  f.LastFailedAt,
+		NextRetryAt:   f.NextRetryAt,
+	}).Error
+}
+
+// DueFailedFetches returns up to limit entries whose next retry is at or
+// before now.
+func (e *GormLog) DueFailedFetches(now time.Time, limit int) ([]model.FailedFetch, error) {
+	var rows []failedFetch
+	tx := e.db.Where("next_retry_at <= ?", now).Order("next_retry_at").Limit(limit).Find(&rows)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	failures := make([]model.FailedFetch, len(rows))
+	for i, row := range rows {
+		failures[i] = toFailedFetch(row)
+	}
+	return failures, nil
+}
+
+// FailedFetches returns every dead-letter entry, most recent failure first.
+func (e *GormLog) FailedFetches() ([]model.FailedFetch, error) {
+	var rows []failedFetch
+	if err := e.db.Order("last_failed_at DESC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	failures := make([]model.FailedFetch, len(rows))
+	for i, row := range rows {
+		failures[i] = toFailedFetch(row)
+	}
+	return failures, nil
+}
+
+func toTransitionEvents(transitions []model.Transition) []transitionEvent {
+	events := make([]transitionEvent, len(transitions))
+	for i, t := range transitions {
+		events[i] = transitionEvent{
+			At:     t.At,
+			ItemID: t.ItemID,
+			Kind:   t.Kind,
+			Before: t.Before,
+			After:  t.After,
+		}
+	}
+	return events
+}
+
+// WriteTransitions writes transitions found between item revisions.
+func (e *GormLog) WriteTransitions(transitions []model.Transition) error {
+	return e.db.Create(toTransitionEvents(transitions)).Error
+}
+
+// GetTransitions returns the transitions recorded in [from, to), oldest
+// first.
+func (e *GormLog) GetTransitions(from, to time.Time) ([]model.Transition, error) {
+	var events []transitionEvent
+	tx := e.db.Where("at >= ? AND at < ?", from, to).Order("at, id").Find(&events)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	transitions := make([]model.Transition, len(events))
+	for i, event := range events {
+		transitions[i] = model.Transition{
+			ItemID: event.ItemID,
+			Kind:   event.Kind,
+			At:     event.At,
+			Before: event.Before,
+			After:  event.After,
+		}
+	}
+	return transitions, nil
+}
+
+// Stats summarizes what the event log holds.
+type Stats struct {
+	ItemEvents       int64
+	ItemObservations int64
+	Items            int64
+	UserEvents       int64
+	Users            int64
+	ListEvents       int64
+	FailedFetches    int64
+	Transitions      int64
+	// MissingItems is how many IDs between the lowest and highest stored
+	// item are not stored, spread over Gaps runs.
+	MissingItems int64
+	Gaps         int
+	// RawPayloads is how many item revisions are still stored uncompressed,
+	// and Dictionary the newest compression dictionary version, 0 if none.
+	RawPayloads int64
+	Dictionary  int
+	LastItemRx  time.Time
+	LastUserRx  time.Time
+	LastListRx  time.Time
+}
+
+func (e *GormLog) Stats() (*Stats, error) {
+	var stats Stats
+	counts := []struct {
+		model any
+		query string
+		count *int64
+	}{
+		{&itemEvent{}, "", &stats.ItemEvents},
+		{&itemObservation{}, "", &stats.ItemObservations},
+		{&currentItem{}, "", &stats.Items},
+		{&userEvent{}, "", &stats.UserEvents},
+		{&userEvent{}, "COUNT(DISTINCT user_id)", &stats.Users},
+		{&listEvent{}, "", &stats.ListEvents},
+		{&failedFetch{}, "", &stats.FailedFetches},
+		{&transitionEvent{}, "", &stats.Transitions},
+		{&itemEvent{}, "COALESCE(SUM(CASE WHEN dict IS NULL THEN 1 ELSE 0 END), 0)", &stats.RawPayloads},
+	}
+	for _, c := range counts {
+		tx := e.db.Model(c.model)
+		if c.query != "" {
+			tx = tx.Select(c.query).Scan(c.count)
+		} else {
+			tx = tx.Count(c.count)
+		}
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+	}
+	latest := []struct {
+		table string
+		at    *time.Time
+	}{
+		{"item_events", &stats.LastItemRx},
+		{"user_events", &stats.LastUserRx},
+		{"list_events", &stats.LastListRx},
+	}
+	for _, l := range latest {
+		var at []time.Time
+		if err := e.db.Raw("SELECT rx_time FROM " + l.table + " ORDER BY rx_time DESC LIMIT 1").Scan(&at).Error; err != nil {
+			return nil, err
+		}
+		if len(at) > 0 {
+			*l.at = at[0]
+		}
+	}
+	stats.Dictionary = e.codec.version
+	ranges, err := e.ItemIDRanges()
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(ranges); i++ {
+		stats.Gaps++
+		stats.MissingItems += int64(ranges[i].Lo - ranges[i-1].Hi - 1)
+	}
+	return &stats, nil
+}
+
+// Vacuum rebuilds the database, returning space freed by deletes to the
+// filesystem.
+func (e *GormLog) Vacuum() error {
+	return e.db.Exec("VACUUM").Error
 }
@@ -0,0 +1,183 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+func TestWriteItemBatchDeduplicates(t *testing.T) {
+	e, err := NewEventLog(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	v1 := json.RawMessage(`{"id":1,"score":1}`)
+	v2 := json.RawMessage(`{"id":1,"score":2}`)
+	batches := [][]model.ItemUpdate{
+		{{RxTime: t0, ID: 1, Data: v1}},
+		{{RxTime: t0.Add(time.Minute), ID: 1, Data: v1}, {RxTime: t0.Add(2 * time.Minute), ID: 1, Data: v2}},
+		{{RxTime: t0.Add(3 * time.Minute), ID: 1, Data: v2}},
+	}
+	for _, batch := range batches {
+		if err := e.WriteItemBatch(batch, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var revisions int64
+	if err := e.db.Model(&itemEvent{}).Where("item_id = ?", 1).Count(&revisions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if revisions != 2 {
+		t.Errorf("stored %d revisions, want 2", revisions)
+	}
+	item, err := e.GetLatestItem(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Score == nil || *item.Score != 2 {
+		t.Errorf("latest score = %v, want 2", item.Score)
+	}
+	times, err := e.ItemObservedTimes(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 4 || !times[0].Equal(t0) || !times[3].Equal(t0.Add(3*time.Minute)) {
+		t.Errorf("observed times = %v, want 4 from %v", times, t0)
+	}
+}
+
+func TestStats(t *testing.T) {
+	e, err := NewEventLog(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	rx := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var updates []model.ItemUpdate
+	for _, id := range []model.ItemID{1, 2, 5, 9} {
+		updates = append(updates, model.ItemUpdate{RxTime: rx, ID: id, Data: json.RawMessage(`{}`)})
+	}
+	if err := e.WriteItemBatch(updates, nil); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := e.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Items != 4 || stats.Gaps != 2 || stats.MissingItems != 5 || !stats.LastItemRx.Equal(rx) {
+		t.Errorf("Stats() = %+v, want 4 items, 5 missing in 2 gaps, last rx %v", stats, rx)
+	}
+	if !stats.LastUserRx.IsZero() {
+		t.Errorf("LastUserRx = %v with no users stored", stats.LastUserRx)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	e, err := NewEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := model.ItemUpdate{RxTime: time.Now(), ID: 1, Data: json.RawMessage(`{"id":1,"title":"A"}`)}
+	if err := e.WriteItemBatch([]model.ItemUpdate{update}, nil); err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	ro, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	item, err := ro.GetLatestItem(1)
+	if err != nil || item.Title == nil || *item.Title != "A" {
+		t.Errorf("GetLatestItem(1) = %v, %v", item, err)
+	}
+	update.RxTime = update.RxTime.Add(time.Second)
+	if err := ro.WriteItemBatch([]model.ItemUpdate{update}, nil); err == nil {
+		t.Error("WriteItemBatch succeeded on a read-only event log")
+	}
+	if _, err := OpenReadOnly(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Error("OpenReadOnly succeeded on a missing file")
+	}
+}
+
+func TestOpenPostgresReadOnly(t *testing.T) {
+	dsn := os.Getenv("FASTHACKER_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("FASTHACKER_TEST_POSTGRES_DSN not set")
+	}
+	e, err := NewPostgres(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	ro, err := OpenPostgresReadOnly(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if _, err := ro.ItemIDRanges(); err != nil {
+		t.Errorf("ItemIDRanges = %v", err)
+	}
+	update := model.ItemUpdate{RxTime: time.Now(), ID: 1, Data: json.RawMessage(`{"id":1,"title":"A"}`)}
+	if err := ro.WriteItemBatch([]model.ItemUpdate{update}, nil); err == nil {
+		t.Error("WriteItemBatch succeeded on a read-only event log")
+	}
+}
+
+func TestCurrentItems(t *testing.T) {
+	e, err := NewEventLog(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	batches := [][]model.ItemUpdate{
+		{
+			{RxTime: t0, ID: 1, Data: json.RawMessage(`{"id":1,"type":"story","by":"pg","title":"a","score":1}`)},
+			{RxTime: t0.Add(time.Minute), ID: 1, Data: json.RawMessage(`{"id":1,"type":"story","by":"pg","title":"b","score":5}`)},
+			{RxTime: t0, ID: 2, Data: json.RawMessage(`{"id":2,"type":"comment","parent":1}`)},
+		},
+		// An older revision arriving late does not replace the current one.
+		{{RxTime: t0.Add(-time.Minute), ID: 1, Data: json.RawMessage(`{"id":1,"type":"story","title":"old"}`)}},
+		{{RxTime: t0.Add(time.Minute), ID: 2, Data: json.RawMessage(`{"id":2,"type":"comment","parent":1,"deleted":true}`)}},
+		// Nor does one received earlier in a zone ahead of UTC, whose
+		// local time reads later.
+		{{RxTime: t0.Add(30 * time.Second).In(time.FixedZone("CEST", 2*60*60)), ID: 1, Data: json.RawMessage(`{"id":1,"type":"story","title":"ahead"}`)}},
+	}
+	for _, batch := range batches {
+		if err := e.WriteItemBatch(batch, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rows []currentItem
+	if err := e.db.Order("item_id").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("%d current items, want 2", len(rows))
+	}
+	story, comment := rows[0], rows[1]
+	if story.Title == nil || *story.Title != "b" || story.Score == nil || *story.Score != 5 || story.By == nil || *story.By != "pg" {
+		t.Errorf("current story = %+v, want title b, score 5 by pg", story)
+	}
+	if comment.Parent == nil || *comment.Parent != 1 || !comment.Deleted || comment.Type != "comment" {
+		t.Errorf("current comment = %+v, want deleted child of 1", comment)
+	}
+	item, err := e.GetLatestItem(1)
+	if err != nil || *item.Title != "b" {
+		t.Errorf("GetLatestItem(1) = %v, %v, want title b", item, err)
+	}
+}
@@ -0,0 +1,290 @@
+package eventlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+type revision struct {
+	rxTime time.Time
+	data   []byte
+}
+
+// MemoryLog is an EventLog held in memory and lost on Close. It is meant
+// for tests.
+type MemoryLog struct {
+	mu           sync.Mutex
+	items        map[model.ItemID][]revision
+	observations map[model.ItemID][]time.Time
+	users        map[model.UserID][]revision
+	lists        map[model.ListName][]revision
+	failed       map[model.ItemID]model.FailedFetch
+	transitions  []model.Transition
+}
+
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{
+		items:        make(map[model.ItemID][]revision),
+		observations: make(map[model.ItemID][]time.Time),
+		users:        make(map[model.UserID][]revision),
+		lists:        make(map[model.ListName][]revision),
+		failed:       make(map[model.ItemID]model.FailedFetch),
+	}
+}
+
+func (m *MemoryLog) Close() error {
+	return nil
+}
+
+// latest returns the revision with the greatest rxTime.
+func latest(revs []revision) (revision, bool) {
+	return latestAt(revs, time.Time{})
+}
+
+// latestAt returns the revision with the greatest rxTime not after at, or
+// the greatest overall if at is zero.
+func latestAt(revs []revision, at time.Time) (revision, bool) {
+	var last revision
+	found := false
+	for _, rev := range revs {
+		if !at.IsZero() && rev.rxTime.After(at) {
+			continue
+		}
+		if !found || !rev.rxTime.Before(last.rxTime) {
+			last, found = rev, true
+		}
+	}
+	return last, found
+}
+
+func (m *MemoryLog) ItemIDRanges() ([]model.ItemIDRange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]model.ItemID, 0, len(m.items))
+	for id := range m.items {
+		ids = append(ids, id)
+	}
+	return idRanges(ids), nil
+}
+
+// idRanges sorts ids and groups them into runs of consecutive IDs.
+func idRanges(ids []model.ItemID) []model.ItemIDRange {
+	slices.Sort(ids)
+	var ranges []model.ItemIDRange
+	for _, id := range ids {
+		if n := len(ranges); n > 0 && ranges[n-1].Hi+1 == id {
+			ranges[n-1].Hi = id
+			continue
+		}
+		ranges = append(ranges, model.ItemIDRange{Lo: id, Hi: id})
+	}
+	return ranges
+}
+
+func (m *MemoryLog) WriteItemBatch(updates []model.ItemUpdate, transitions []model.Transition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, update := range updates {
+		if last, ok := latest(m.items[update.ID]); ok && bytes.Equal(last.data, update.Data) {
+			m.observations[update.ID] = append(m.observations[update.ID], update.RxTime)
+			continue
+		}
+		m.items[update.ID] = append(m.items[update.ID], revision{rxTime: update.RxTime, data: update.Data})
+	}
+	for _, update := range updates {
+		delete(m.failed, update.ID)
+	}
+	m.transitions = append(m.transitions, transitions...)
+	return nil
+}
+
+func (m *MemoryLog) GetLatestItem(id model.ItemID) (*model.Item, error) {
+	return m.GetItemAt(id, time.Time{})
+}
+
+func (m *MemoryLog) GetItemAt(id model.ItemID, at time.Time) (*model.Item, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last, ok := latestAt(m.items[id], at)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var item model.Item
+	if err := json.Unmarshal(last.data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (m *MemoryLog) LatestItems(ids []model.ItemID) (map[model.ItemID]*model.Item, error) {
+	items := make(map[model.ItemID]*model.Item, len(ids))
+	for _, id := range ids {
+		item, err := m.GetLatestItem(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items[id] = item
+	}
+	return items, nil
+}
+
+func (m *MemoryLog) ItemObservedTimes(id model.ItemID) ([]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var times []time.Time
+	for _, rev := range m.items[id] {
+		times = append(times, rev.rxTime)
+	}
+	times = append(times, m.observations[id]...)
+	slices.SortFunc(times, time.Time.Compare)
+	return times, nil
+}
+
+func (m *MemoryLog) WriteUserBatch(updates []model.UserUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, update := range updates {
+		m.users[update.ID] = append(m.users[update.ID], revision{rxTime: update.RxTime, data: update.Data})
+	}
+	return nil
+}
+
+func (m *MemoryLog) GetLatestUser(id model.UserID) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last, ok := latest(m.users[id])
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var user model.User
+	if err := json.Unmarshal(last.data, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (m *MemoryLog) WriteList(listUpdate model.ListUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lists[listUpdate.ID] = append(m.lists[listUpdate.ID], revision{rxTime: listUpdate.RxTime, data: listUpdate.Data})
+	return nil
+}
+
+func (m *MemoryLog) GetList(name model.ListName) (*model.StoryList, error) {
+	return m.GetListAt(name, time.Time{})
+}
+
+func (m *MemoryLog) GetListAt(name model.ListName, at time.Time) (*model.StoryList, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last, ok := latestAt(m.lists[name], at)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if last.data == nil {
+		return nil, nil
+	}
+	var list model.StoryList
+	if err := json.Unmarshal(last.data, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (m *MemoryLog) GetFailedFetch(id model.ItemID) (*model.FailedFetch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.failed[id]
+	if !ok {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+func (m *MemoryLog) PutFailedFetch(f model.FailedFetch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failed[f.ItemID] = f
+	return nil
+}
+
+// sortedFailures returns the dead-letter entries that keep accepts, ordered
+// by less.
+func sortedFailures(failed map[model.ItemID]model.FailedFetch, keep func(model.FailedFetch) bool, less func(a, b model.FailedFetch) bool) []model.FailedFetch {
+	failures := []model.FailedFetch{}
+	for _, f := range failed {
+		if keep(f) {
+			failures = append(failures, f)
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return less(failures[i], failures[j])
+	})
+	return failures
+}
+
+func (m *MemoryLog) DueFailedFetches(now time.Time, limit int) ([]model.FailedFetch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return dueFailedFetches(m.failed, now, limit), nil
+}
+
+func dueFailedFetches(failed map[model.ItemID]model.FailedFetch, now time.Time, limit int) []model.FailedFetch {
+	failures := sortedFailures(failed, func(f model.FailedFetch) bool {
+		return !f.NextRetryAt.After(now)
+	}, func(a, b model.FailedFetch) bool {
+		return a.NextRetryAt.Before(b.NextRetryAt)
+	})
+	return failures[:min(limit, len(failures))]
+}
+
+func (m *MemoryLog) FailedFetches() ([]model.FailedFetch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return allFailedFetches(m.failed), nil
+}
+
+func allFailedFetches(failed map[model.ItemID]model.FailedFetch) []model.FailedFetch {
+	return sortedFailures(failed, func(model.FailedFetch) bool {
+		return true
+	}, func(a, b model.FailedFetch) bool {
+		return a.LastFailedAt.After(b.LastFailedAt)
+	})
+}
+
+func (m *MemoryLog) WriteTransitions(transitions []model.Transition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transitions = append(m.transitions, transitions...)
+	return nil
+}
+
+func (m *MemoryLog) GetTransitions(from, to time.Time) ([]model.Transition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return transitionsIn(m.transitions, from, to), nil
+}
+
+// transitionsIn returns the transitions in [from, to), oldest first.
+func transitionsIn(all []model.Transition, from, to time.Time) []model.Transition {
+	transitions := []model.Transition{}
+	for _, t := range all {
+		if !t.At.Before(from) && t.At.Before(to) {
+			transitions = append(transitions, t)
+		}
+	}
+	sort.SliceStable(transitions, func(i, j int) bool {
+		return transitions[i].At.Before(transitions[j].At)
+	})
+	return transitions
+}
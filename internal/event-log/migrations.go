@@ -0,0 +1,408 @@
+package eventlog
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// schemaMigration records a migration applied to the database.
+type schemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// migration is one numbered step of the schema. Versions are never reused
+// or reordered; a schema change is a new migration at the end of the list.
+//
+// The steps up to 7 were applied without being recorded before versioning
+// was added, so they check what already exists and adopt such databases.
+//
+// Steps build tables from the snapshot structs below, never from the
+// structs the event log reads and writes, so a step creates the same
+// schema however those change later.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+func createTable(value any) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		if tx.Migrator().HasTable(value) {
+			return nil
+		}
+		return tx.Migrator().CreateTable(value)
+	}
+}
+
+func addColumn(value any, field string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		if tx.Migrator().HasColumn(value, field) {
+			return nil
+		}
+		return tx.Migrator().AddColumn(value, field)
+	}
+}
+
+func createIndexes(value any, fields ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, field := range fields {
+			if tx.Migrator().HasIndex(value, field) {
+				continue
+			}
+			if err := tx.Migrator().CreateIndex(value, field); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+var migrations = []migration{
+	{1, "create item_events", createTable(&itemEventV1{})},
+	{2, "create user_events", createTable(&userEventV2{})},
+	{3, "create list_events from top_stories_events", func(tx *gorm.DB) error {
+		if err := createTable(&listEventV3{})(tx); err != nil {
+			return err
+		}
+		if !tx.Migrator().HasTable(&topStoriesEvent{}) {
+			return nil
+		}
+		err := tx.Exec("INSERT INTO list_events (rx_time, list, data) SELECT rx_time, ?, data FROM top_stories_events", model.ListTop).Error
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().DropTable(&topStoriesEvent{})
+	}},
+	{4, "create failed_fetches", createTable(&failedFetchV4{})},
+	{5, "add item_events.hash", addColumn(&itemEventHashV5{}, "Hash")},
+	{6, "create item_observations", createTable(&itemObservationV6{})},
+	{7, "create transition_events", createTable(&transitionEventV7{})},
+	{8, "create current_items from item_events", backfillCurrentItemsV8},
+	{9, "add payload compression", func(tx *gorm.DB) error {
+		for _, value := range []any{&itemEventDictV9{}, &listEventDictV9{}, &currentItemDictV9{}} {
+			if err := addColumn(value, "Dict")(tx); err != nil {
+				return err
+			}
+		}
+		return createTable(&dictionaryV9{})(tx)
+	}},
+	{10, "index current_items filter and sort columns", createIndexes(&currentItemIndexesV10{}, "Score", "Descendants", "Title", "Dead", "Deleted")},
+	{11, "index raw payloads", func(tx *gorm.DB) error {
+		// Partial indexes over the rows Recompress still has to compress,
+		// which are empty once it is done.
+		for _, t := range []struct{ table, key string }{{"item_events", "id"}, {"list_events", "id"}, {"current_items", "item_id"}} {
+			err := tx.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%[1]s_raw ON %[1]s (%[2]s) WHERE dict IS NULL AND data IS NOT NULL", t.table, t.key)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{12, "store SQLite times as Unix nanoseconds", timesToUnixNanoV12},
+}
+
+// SchemaVersion is the newest schema this build knows.
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// ErrSchemaTooNew means the database was migrated by a newer build.
+var ErrSchemaTooNew = errors.New("event log schema is newer than this build")
+
+// checkSchemaVersion returns the version the database is at, 0 if it has
+// never been migrated, and fails if that is newer than SchemaVersion.
+func checkSchemaVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&schemaMigration{}) {
+		return 0, nil
+	}
+	var version int
+	if err := db.Model(&schemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error; err != nil {
+		return 0, err
+	}
+	if version > SchemaVersion {
+		return version, fmt.Errorf("%w: at version %d, this build knows up to %d", ErrSchemaTooNew, version, SchemaVersion)
+	}
+	return version, nil
+}
+
+// migrate applies every migration newer than the database's version, each
+// in its own transaction together with its schema_migrations row.
+func migrate(db *gorm.DB) error {
+	if err := createTable(&schemaMigration{})(db); err != nil {
+		return err
+	}
+	version, err := checkSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		fmt.Printf("eventlog: migration %d: %s\n", m.version, m.name)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&schemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// topStoriesEvent is the table lists were stored in before every story list
+// was synced. Migration 3 moves its rows into list_events.
+type topStoriesEvent struct {
+	ID     uint64    `gorm:"primaryKey;autoIncrement:true"`
+	RxTime time.Time `gorm:"uniqueIndex:idx_rxtime"`
+	Data   []byte
+}
+
+// The tables as each migration creates or changes them. A snapshot is never
+// edited once its migration is released.
+
+type itemEventV1 struct {
+	ID     uint64    `gorm:"primaryKey;autoIncrement:true"`
+	RxTime time.Time `gorm:"uniqueIndex:idx_itemid_rxtime,priority:2"`
+	ItemID int64     `gorm:"uniqueIndex:idx_itemid_rxtime,priority:1"`
+	Data   []byte
+}
+
+func (itemEventV1) TableName() string { return "item_events" }
+
+type userEventV2 struct {
+	ID     uint64    `gorm:"primaryKey;autoIncrement:true"`
+	RxTime time.Time `gorm:"uniqueIndex:idx_userid_rxtime,priority:2"`
+	UserID string    `gorm:"uniqueIndex:idx_userid_rxtime,priority:1"`
+	Data   []byte
+}
+
+func (userEventV2) TableName() string { return "user_events" }
+
+type listEventV3 struct {
+	ID     uint64    `gorm:"primaryKey;autoIncrement:true"`
+	RxTime time.Time `gorm:"uniqueIndex:idx_list_rxtime,priority:2"`
+	List   string    `gorm:"uniqueIndex:idx_list_rxtime,priority:1"`
+	Data   []byte
+}
+
+func (listEventV3) TableName() string { return "list_events" }
+
+type failedFetchV4 struct {
+	ItemID        int64 `gorm:"primaryKey;autoIncrement:false"`
+	Class         string
+	Attempts      int
+	LastError     string
+	FirstFailedAt time.Time
+	LastFailedAt  time.Time
+	NextRetryAt   time.Time `gorm:"index"`
+}
+
+func (failedFetchV4) TableName() string { return "failed_fetches" }
+
+type itemEventHashV5 struct {
+	Hash []byte
+}
+
+func (itemEventHashV5) TableName() string { return "item_events" }
+
+type itemObservationV6 struct {
+	ID     uint64    `gorm:"primaryKey;autoIncrement:true"`
+	RxTime time.Time `gorm:"uniqueIndex:idx_observation_itemid_rxtime,priority:2"`
+	ItemID int64     `gorm:"uniqueIndex:idx_observation_itemid_rxtime,priority:1"`
+}
+
+func (itemObservationV6) TableName() string { return "item_observations" }
+
+type transitionEventV7 struct {
+	ID     uint64    `gorm:"primaryKey;autoIncrement:true"`
+	At     time.Time `gorm:"index"`
+	ItemID int64     `gorm:"index"`
+	Kind   string
+	Before string
+	After  string
+}
+
+func (transitionEventV7) TableName() string { return "transition_events" }
+
+type currentItemV8 struct {
+	ItemID      int64 `gorm:"primaryKey;autoIncrement:false"`
+	RxTime      time.Time
+	Type        string    `gorm:"index"`
+	By          *string   `gorm:"index"`
+	Time        time.Time `gorm:"index"`
+	Parent      *int64    `gorm:"index"`
+	Score       *int
+	Descendants *int
+	Title       *string
+	URL         *string
+	Dead        bool
+	Deleted     bool
+	Data        []byte
+	Hash        []byte
+}
+
+func (currentItemV8) TableName() string { return "current_items" }
+
+type itemEventDictV9 struct {
+	Dict *int
+}
+
+func (itemEventDictV9) TableName() string { return "item_events" }
+
+type listEventDictV9 struct {
+	Dict *int
+}
+
+func (listEventDictV9) TableName() string { return "list_events" }
+
+type currentItemDictV9 struct {
+	Dict *int
+}
+
+func (currentItemDictV9) TableName() string { return "current_items" }
+
+type dictionaryV9 struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Data      []byte
+	Samples   int
+	CreatedAt time.Time
+}
+
+func (dictionaryV9) TableName() string { return "dictionaries" }
+
+type currentItemIndexesV10 struct {
+	Score       *int    `gorm:"index"`
+	Descendants *int    `gorm:"index"`
+	Title       *string `gorm:"index"`
+	Dead        bool    `gorm:"index"`
+	Deleted     bool    `gorm:"index"`
+}
+
+func (currentItemIndexesV10) TableName() string { return "current_items" }
+
+// backfillCurrentItemsV8 fills current_items from item_events, a chunk of
+// items at a time.
+func backfillCurrentItemsV8(tx *gorm.DB) error {
+	if err := createTable(&currentItemV8{})(tx); err != nil {
+		return err
+	}
+	const chunk = 1000
+	var after int64
+	for {
+		var events []struct {
+			ItemID int64
+			RxTime time.Time
+			Data   []byte
+			Hash   []byte
+		}
+		err := tx.Raw(`SELECT e.item_id, e.rx_time, e.data, e.hash
+			FROM item_events AS e
+			WHERE e.item_id > ?
+			AND e.rx_time = (SELECT MAX(rx_time) FROM item_events WHERE item_id = e.item_id)
+			ORDER BY e.item_id
+			LIMIT ?`, after, chunk).Scan(&events).Error
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		items := make([]currentItemV8, len(events))
+		for i, event := range events {
+			if event.Hash == nil {
+				sum := sha256.Sum256(event.Data)
+				event.Hash = sum[:]
+			}
+			current := currentItemV8{ItemID: event.ItemID, RxTime: event.RxTime, Data: event.Data, Hash: event.Hash}
+			var item model.Item
+			if err := json.Unmarshal(event.Data, &item); err == nil {
+				current.Type = item.Type
+				current.By = (*string)(item.By)
+				current.Time = item.Time.Time
+				current.Parent = (*int64)(item.Parent)
+				current.Score = item.Score
+				current.Descendants = item.Descendants
+				current.Title = item.Title
+				current.URL = item.URL
+				current.Dead = item.Dead != nil && *item.Dead
+				current.Deleted = item.Deleted != nil && *item.Deleted
+			}
+			items[i] = current
+		}
+		err = tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "item_id"}},
+			Where:     clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "excluded.rx_time >= current_items.rx_time"}}},
+			UpdateAll: true,
+		}).Create(items).Error
+		if err != nil {
+			return err
+		}
+		after = events[len(events)-1].ItemID
+		fmt.Printf("eventlog: current_items backfilled through item %d\n", after)
+	}
+}
+
+// timesToUnixNanoV12 rewrites the times SQLite stored as RFC 3339 text as
+// integer Unix nanoseconds, the format open now writes. Postgres stores
+// timestamps natively and is left alone.
+func timesToUnixNanoV12(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "sqlite" {
+		return nil
+	}
+	for _, t := range []struct {
+		table, key string
+		columns    []string
+	}{
+		{"item_events", "id", []string{"rx_time"}},
+		{"item_observations", "id", []string{"rx_time"}},
+		{"user_events", "id", []string{"rx_time"}},
+		{"list_events", "id", []string{"rx_time"}},
+		{"failed_fetches", "item_id", []string{"first_failed_at", "last_failed_at", "next_retry_at"}},
+		{"transition_events", "id", []string{"at"}},
+		{"current_items", "item_id", []string{"rx_time", "time"}},
+		{"dictionaries", "version", []string{"created_at"}},
+		{"schema_migrations", "version", []string{"applied_at"}},
+	} {
+		for _, column := range t.columns {
+			if err := textTimesToUnixNano(tx, t.table, t.key, column); err != nil {
+				return fmt.Errorf("%s.%s: %w", t.table, column, err)
+			}
+		}
+	}
+	return nil
+}
+
+// textTimesToUnixNano rewrites the text times of one column in a single
+// UPDATE, leaving rows already stored as integers alone. SQLite's strftime
+// reads the RFC 3339 text, zone included, to whole seconds; the fraction,
+// which it would round to milliseconds, is taken from the text itself.
+func textTimesToUnixNano(tx *gorm.DB, table, key, column string) error {
+	var bad struct {
+		RowKey int64
+		Value  string
+	}
+	err := tx.Raw(fmt.Sprintf("SELECT %[2]s AS row_key, %[3]s AS value FROM %[1]s WHERE typeof(%[3]s) = 'text' AND strftime('%%s', %[3]s) IS NULL LIMIT 1", table, key, column)).Scan(&bad).Error
+	if err != nil {
+		return err
+	}
+	if bad.Value != "" {
+		return fmt.Errorf("row %d: %q is not an RFC 3339 time", bad.RowKey, bad.Value)
+	}
+	// The fraction runs from after the '.' at position 20 to before the
+	// zone, which is Z or ±hh:mm.
+	fraction := fmt.Sprintf("substr(%[1]s, 21, length(%[1]s) - 20 - CASE WHEN substr(%[1]s, -1) = 'Z' THEN 1 ELSE 6 END)", column)
+	return tx.Exec(fmt.Sprintf(`UPDATE %[1]s SET %[2]s = CAST(strftime('%%s', %[2]s) AS INTEGER) * 1000000000
+		+ CASE WHEN substr(%[2]s, 20, 1) = '.' THEN CAST(substr(%[3]s || '000000000', 1, 9) AS INTEGER) ELSE 0 END
+		WHERE typeof(%[2]s) = 'text'`, table, column, fraction)).Error
+}
@@ -0,0 +1,186 @@
+package eventlog
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ncruces/go-sqlite3/gormlite"
+	"gorm.io/gorm"
+)
+
+func TestMigrateAdoptsUnversionedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The schema as first released: item events without hashes and top
+	// stories in their own table.
+	err = db.Exec(`CREATE TABLE item_events (id integer PRIMARY KEY AUTOINCREMENT, rx_time datetime, item_id integer, data blob)`).Error
+	if err == nil {
+		err = db.Exec(`CREATE TABLE top_stories_events (id integer PRIMARY KEY AUTOINCREMENT, rx_time datetime, data blob)`).Error
+	}
+	if err == nil {
+		err = db.Exec(`INSERT INTO top_stories_events (rx_time, data) VALUES (?, '[1]')`, time.Now()).Error
+	}
+	for i, title := range []string{"first", "second"} {
+		if err == nil {
+			err = db.Exec(`INSERT INTO item_events (rx_time, item_id, data) VALUES (?, 1, ?)`,
+				time.Now().Add(time.Duration(i)*time.Minute), []byte(`{"id":1,"type":"story","title":"`+title+`"}`)).Error
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	e, err := NewEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if !e.db.Migrator().HasColumn(&itemEvent{}, "Hash") || e.db.Migrator().HasTable(&topStoriesEvent{}) {
+		t.Error("old schema not migrated")
+	}
+	var versions []int
+	if err := e.db.Model(&schemaMigration{}).Order("version").Pluck("version", &versions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != len(migrations) || versions[len(versions)-1] != SchemaVersion {
+		t.Errorf("recorded versions %v, want 1 to %d", versions, SchemaVersion)
+	}
+	if list, err := e.GetList("topstories"); err != nil || len(*list) != 1 {
+		t.Errorf("moved top stories = %v, %v", list, err)
+	}
+	if item, err := e.GetLatestItem(1); err != nil || item.Title == nil || *item.Title != "second" {
+		t.Errorf("backfilled current item = %v, %v", item, err)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	e, err := NewEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.db.Create(&schemaMigration{Version: SchemaVersion + 1, Name: "from the future", AppliedAt: time.Now()}).Error
+	e.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewEventLog(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("NewEventLog = %v, want ErrSchemaTooNew", err)
+	}
+	if _, err := OpenReadOnly(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("OpenReadOnly = %v, want ErrSchemaTooNew", err)
+	}
+}
+
+// TestMigrationsMatchModels checks that the frozen migrations build every
+// column and index the event log's structs expect, so a struct change
+// without a migration is caught.
+func TestMigrationsMatchModels(t *testing.T) {
+	e, err := NewEventLog(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	for _, value := range []any{&itemEvent{}, &itemObservation{}, &userEvent{}, &listEvent{}, &failedFetch{}, &transitionEvent{}, &currentItem{}, &dictionary{}} {
+		stmt := &gorm.Statement{DB: e.db}
+		if err := stmt.Parse(value); err != nil {
+			t.Fatal(err)
+		}
+		table := stmt.Schema.Table
+		if !e.db.Migrator().HasTable(table) {
+			t.Errorf("no table %s", table)
+			continue
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !e.db.Migrator().HasColumn(value, field.DBName) {
+				t.Errorf("no column %s.%s", table, field.DBName)
+			}
+		}
+		for _, index := range stmt.Schema.ParseIndexes() {
+			if !e.db.Migrator().HasIndex(value, index.Name) {
+				t.Errorf("no index %s on %s", index.Name, table)
+			}
+		}
+	}
+}
+
+func TestMigrateRewritesTextTimes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	e, err := NewEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+	// Before migration 12 the driver wrote RFC 3339 text, keeping the
+	// zone and trimming fractional seconds.
+	db, err := openDialector(gormlite.Open(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	cest := time.FixedZone("CEST", 2*60*60)
+	revisions := []struct {
+		rx    time.Time
+		title string
+	}{
+		{t0.In(cest), "a"},
+		{t0.Add(500 * time.Millisecond), "b"},
+		{t0.Add(time.Second), "c"},
+		{t0.Add(2*time.Second + 123456789).In(time.FixedZone("", -90*60)), "d"},
+	}
+	for _, r := range revisions {
+		if err == nil {
+			err = db.Exec(`INSERT INTO item_events (rx_time, item_id, data) VALUES (?, 1, ?)`, r.rx, []byte(`{"id":1,"title":"`+r.title+`"}`)).Error
+		}
+	}
+	if err == nil {
+		err = db.Exec(`DELETE FROM schema_migrations WHERE version = 12`).Error
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	e, err = NewEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var kinds []string
+	if err := e.db.Raw(`SELECT DISTINCT typeof(rx_time) FROM item_events`).Scan(&kinds).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(kinds) != 1 || kinds[0] != "integer" {
+		t.Errorf("rx_time stored as %v, want integer", kinds)
+	}
+	var stored []int64
+	if err := e.db.Raw(`SELECT CAST(rx_time AS INTEGER) FROM item_events ORDER BY id`).Scan(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range revisions {
+		if i >= len(stored) || stored[i] != r.rx.UnixNano() {
+			t.Errorf("revision %s stored as %v, want %d", r.title, stored, r.rx.UnixNano())
+		}
+	}
+	for at, want := range map[time.Time]string{
+		t0.Add(250 * time.Millisecond).In(cest): "a",
+		t0.Add(750 * time.Millisecond):          "b",
+		t0.Add(time.Second):                     "c",
+	} {
+		item, err := e.GetItemAt(1, at)
+		if err != nil || item.Title == nil || *item.Title != want {
+			t.Errorf("GetItemAt(%v) = %v, %v, want title %s", at, item, err, want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package eventlog
+
+import (
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/driver/postgres"
+)
+
+// NewPostgres opens the event log in the Postgres database named by dsn,
+// creating and migrating its tables as needed. It shares the schema and
+// queries of the SQLite log.
+func NewPostgres(dsn string) (*GormLog, error) {
+	db, err := openDialector(postgres.Open(dsn))
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		return nil, err
+	}
+	return newGormLog(db)
+}
+
+// OpenPostgresReadOnly opens an existing event log in Postgres without
+// migrating it. Its sessions default to read-only transactions, so every
+// write through it fails.
+func OpenPostgresReadOnly(dsn string) (*GormLog, error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	config.RuntimeParams["default_transaction_read_only"] = "on"
+	db, err := openDialector(postgres.New(postgres.Config{Conn: stdlib.OpenDB(*config)}))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReadable(db, "the Postgres database"); err != nil {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		return nil, err
+	}
+	return newGormLog(db)
+}
@@ -0,0 +1,1052 @@
+package eventlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+// RecordType says what a segment record holds.
+type RecordType string
+
+const (
+	RecordItem RecordType = "item"
+	// RecordObserved is an item fetched unchanged; Same points at the
+	// revision it matched.
+	RecordObserved   RecordType = "observed"
+	RecordUser       RecordType = "user"
+	RecordList       RecordType = "list"
+	RecordFailed     RecordType = "failed"
+	RecordCleared    RecordType = "cleared"
+	RecordTransition RecordType = "transition"
+)
+
+// Position is where a record starts: a byte offset into a segment.
+type Position struct {
+	Segment int   `json:"seg"`
+	Offset  int64 `json:"off"`
+}
+
+// Record is one line of a segment file.
+type Record struct {
+	Type   RecordType      `json:"type"`
+	RxTime time.Time       `json:"rx"`
+	ItemID model.ItemID    `json:"item,omitempty"`
+	UserID model.UserID    `json:"user,omitempty"`
+	List   model.ListName  `json:"list,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Same   *Position       `json:"same,omitempty"`
+	// Prev is where the previous record of the same item or list starts,
+	// nil for its first. Older revisions are found by following these links
+	// back from the newest.
+	Prev        *Position          `json:"prev,omitempty"`
+	FailedFetch *model.FailedFetch `json:"failed,omitempty"`
+	Transition  *model.Transition  `json:"transition,omitempty"`
+}
+
+// indexLine is a record without its data, as kept in a segment's index file.
+// Sum is the SHA-256 of an item revision's data.
+type indexLine struct {
+	Offset int64  `json:"off"`
+	Sum    []byte `json:"sum,omitempty"`
+	Record
+}
+
+// dataSum returns the Sum of rec's index line.
+func dataSum(rec Record) []byte {
+	if rec.Type != RecordItem {
+		return nil
+	}
+	sum := sha256.Sum256(rec.Data)
+	return sum[:]
+}
+
+type revisionEntry struct {
+	rx  time.Time
+	pos Position
+}
+
+// itemHead is an item's latest revision and the sum of its data, which
+// WriteItemBatch compares new revisions against, and its newest record,
+// revision or observation, which the next one links back to.
+type itemHead struct {
+	revisionEntry
+	last Position
+	sum  [sha256.Size]byte
+}
+
+// listHead is a list's latest revision and its newest one, which the next
+// links back to.
+type listHead struct {
+	revisionEntry
+	last revisionEntry
+}
+
+// segmentSummary is what the index keeps of each segment: where each
+// list's revisions in it begin and end, and the time range of its
+// transitions.
+type segmentSummary struct {
+	lists           map[model.ListName]listSpan
+	transitions     int
+	firstTransition time.Time
+	lastTransition  time.Time
+}
+
+// listSpan is when a list's first revision in a segment was received and
+// where its last one starts.
+type listSpan struct {
+	first time.Time
+	last  Position
+}
+
+// latestEntry returns the entry with the greatest rx not after at.
+func latestEntry(entries []revisionEntry, at time.Time) (revisionEntry, bool) {
+	var last revisionEntry
+	found := false
+	for _, entry := range entries {
+		if entry.rx.After(at) {
+			continue
+		}
+		if !found || !entry.rx.Before(last.rx) {
+			last, found = entry, true
+		}
+	}
+	return last, found
+}
+
+const defaultMaxSegmentSize = 64 << 20
+
+// ErrReadOnly is returned by writes to a segment log opened read-only.
+var ErrReadOnly = errors.New("segment log is opened read-only")
+
+// SegmentLog is an EventLog kept as append-only JSONL files in a directory.
+// Records go to the newest segment, NNNNNNNN.jsonl, until it passes
+// maxSegmentSize; then it is sealed, an NNNNNNNN.idx file is written with
+// every record's offset and metadata but not its data, and a new segment is
+// started. Opening a log reads the index files plus the newest segment.
+//
+// The index held in memory is sparse: the latest revision of each item,
+// user and list, with each item's newest record and the sum of its data,
+// about 120 bytes an item however many revisions it has, and a summary of
+// each segment. Every item and list record links back to the one before it,
+// so older revisions are found by following the links through the segments
+// on demand, only within the one segment a list's revision at a given time
+// must be in. Transitions are read back from the index files of the sealed
+// segments their time range overlaps. Failed fetches are held whole.
+type SegmentLog struct {
+	mu             sync.Mutex
+	dir            string
+	readOnly       bool
+	maxSegmentSize int64
+	active         *os.File
+	activeSeq      int
+	activeSize     int64
+	readers        map[int]*os.File
+
+	items     map[model.ItemID]itemHead
+	users     map[model.UserID]revisionEntry
+	lists     map[model.ListName]listHead
+	summaries map[int]*segmentSummary
+	failed    map[model.ItemID]model.FailedFetch
+	// activeTransitions are the transitions in the newest segment.
+	activeTransitions []model.Transition
+	// unlinkedItems and unlinkedLists are records written before records
+	// linked back to the previous one, which the links cannot reach.
+	unlinkedItems map[model.ItemID][]Position
+	unlinkedLists map[model.ListName][]revisionEntry
+}
+
+func segmentPath(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d.jsonl", seq))
+}
+
+func indexPath(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d.idx", seq))
+}
+
+// segments returns the sequence numbers of the segments in dir, in order.
+func segments(dir string) ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, path := range paths {
+		var seq int
+		if _, err := fmt.Sscanf(filepath.Base(path), "%08d.jsonl", &seq); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	slices.Sort(seqs)
+	return seqs, nil
+}
+
+// OpenSegments opens the segment log in dir, creating it if needed. A
+// record torn by a crash at the end of the newest segment is truncated.
+func OpenSegments(dir string) (*SegmentLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return openSegments(dir, false)
+}
+
+// OpenSegmentsReadOnly opens an existing segment log without changing any
+// file in it: a torn record at the end is skipped rather than truncated,
+// missing index files are not written, and every write fails with
+// ErrReadOnly.
+func OpenSegmentsReadOnly(dir string) (*SegmentLog, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return openSegments(dir, true)
+}
+
+func openSegments(dir string, readOnly bool) (*SegmentLog, error) {
+	s := &SegmentLog{
+		dir:            dir,
+		readOnly:       readOnly,
+		maxSegmentSize: defaultMaxSegmentSize,
+		readers:        make(map[int]*os.File),
+		items:          make(map[model.ItemID]itemHead),
+		users:          make(map[model.UserID]revisionEntry),
+		lists:          make(map[model.ListName]listHead),
+		summaries:      make(map[int]*segmentSummary),
+		failed:         make(map[model.ItemID]model.FailedFetch),
+		unlinkedItems:  make(map[model.ItemID][]Position),
+		unlinkedLists:  make(map[model.ListName][]revisionEntry),
+	}
+	seqs, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) == 0 {
+		seqs = []int{1}
+	}
+	for _, seq := range seqs[:len(seqs)-1] {
+		if err := s.loadSealed(seq); err != nil {
+			return nil, fmt.Errorf("segment %d: %w", seq, err)
+		}
+	}
+	if err := s.openActive(seqs[len(seqs)-1]); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SegmentLog) loadSealed(seq int) error {
+	lines, err := readIndex(indexPath(s.dir, seq))
+	if errors.Is(err, os.ErrNotExist) || err == nil && !hasSums(lines) {
+		// Sealed but the index was never written, or was written before
+		// it kept sums; rebuild it.
+		lines, err = scanIndex(segmentPath(s.dir, seq))
+		if err == nil && !s.readOnly {
+			err = writeIndex(indexPath(s.dir, seq), lines)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		s.apply(line, seq)
+	}
+	return nil
+}
+
+func (s *SegmentLog) openActive(seq int) error {
+	path := segmentPath(s.dir, seq)
+	s.activeSeq = seq
+	end, err := scanSegment(path, func(rec Record, off int64) error {
+		s.apply(indexLine{Offset: off, Sum: dataSum(rec), Record: rec}, seq)
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("segment %d: %w", seq, err)
+	}
+	s.activeSize = end
+	if s.readOnly {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	s.active = f
+	return nil
+}
+
+// scanSegment calls fn with every complete record in a segment and returns
+// the offset just past the last one.
+func scanSegment(path string, fn func(rec Record, off int64) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var off int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return off, nil
+		}
+		if err != nil {
+			return off, err
+		}
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return off, fmt.Errorf("offset %d: %w", off, err)
+		}
+		if err := fn(rec, off); err != nil {
+			return off, err
+		}
+		off += int64(len(line))
+	}
+}
+
+// scanIndex returns the index lines of a segment.
+func scanIndex(path string) ([]indexLine, error) {
+	var lines []indexLine
+	_, err := scanSegment(path, func(rec Record, off int64) error {
+		line := indexLine{Offset: off, Sum: dataSum(rec), Record: rec}
+		line.Data = nil
+		lines = append(lines, line)
+		return nil
+	})
+	return lines, err
+}
+
+// readIndex reads a sealed segment's index file.
+func readIndex(path string) ([]indexLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []indexLine
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var line indexLine
+		if err := decoder.Decode(&line); err == io.EOF {
+			return lines, nil
+		} else if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+}
+
+// sealedIndex returns the index lines of a sealed segment, from its index
+// file or, if that was never written, from the segment itself.
+func (s *SegmentLog) sealedIndex(seq int) ([]indexLine, error) {
+	lines, err := readIndex(indexPath(s.dir, seq))
+	if errors.Is(err, os.ErrNotExist) {
+		return scanIndex(segmentPath(s.dir, seq))
+	}
+	return lines, err
+}
+
+// hasSums reports whether every item revision in an index has its sum.
+func hasSums(lines []indexLine) bool {
+	for _, line := range lines {
+		if line.Type == RecordItem && len(line.Sum) != sha256.Size {
+			return false
+		}
+	}
+	return true
+}
+
+// writeIndex writes the index file of a sealed segment.
+func writeIndex(path string, lines []indexLine) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, line := range lines {
+		if err = encoder.Encode(line); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// apply adds a record of segment seq to the in-memory index.
+func (s *SegmentLog) apply(line indexLine, seq int) {
+	rec, pos := line.Record, Position{Segment: seq, Offset: line.Offset}
+	summary := s.summaries[seq]
+	if summary == nil {
+		summary = &segmentSummary{lists: make(map[model.ListName]listSpan)}
+		s.summaries[seq] = summary
+	}
+	switch rec.Type {
+	case RecordItem, RecordObserved:
+		head, ok := s.items[rec.ItemID]
+		if !ok && rec.Type == RecordObserved {
+			return
+		}
+		if ok && rec.Prev == nil {
+			unlinked := s.unlinkedItems[rec.ItemID]
+			if len(unlinked) == 0 {
+				unlinked = append(unlinked, head.last)
+			}
+			s.unlinkedItems[rec.ItemID] = append(unlinked, pos)
+		}
+		if rec.Type == RecordItem && (!ok || !rec.RxTime.Before(head.rx)) {
+			head.revisionEntry = revisionEntry{rx: rec.RxTime, pos: pos}
+			copy(head.sum[:], line.Sum)
+		}
+		head.last = pos
+		s.items[rec.ItemID] = head
+	case RecordUser:
+		if last, ok := s.users[rec.UserID]; !ok || !rec.RxTime.Before(last.rx) {
+			s.users[rec.UserID] = revisionEntry{rx: rec.RxTime, pos: pos}
+		}
+	case RecordList:
+		entry := revisionEntry{rx: rec.RxTime, pos: pos}
+		head, ok := s.lists[rec.List]
+		if ok && rec.Prev == nil {
+			unlinked := s.unlinkedLists[rec.List]
+			if len(unlinked) == 0 {
+				unlinked = append(unlinked, head.last)
+			}
+			s.unlinkedLists[rec.List] = append(unlinked, entry)
+		}
+		if !ok || !entry.rx.Before(head.rx) {
+			head.revisionEntry = entry
+		}
+		head.last = entry
+		s.lists[rec.List] = head
+		span, ok := summary.lists[rec.List]
+		if !ok || entry.rx.Before(span.first) {
+			span.first = entry.rx
+		}
+		span.last = pos
+		summary.lists[rec.List] = span
+	case RecordFailed:
+		s.failed[rec.FailedFetch.ItemID] = *rec.FailedFetch
+	case RecordCleared:
+		delete(s.failed, rec.ItemID)
+	case RecordTransition:
+		at := rec.Transition.At
+		if summary.transitions == 0 || at.Before(summary.firstTransition) {
+			summary.firstTransition = at
+		}
+		if summary.transitions == 0 || at.After(summary.lastTransition) {
+			summary.lastTransition = at
+		}
+		summary.transitions++
+		if seq == s.activeSeq {
+			s.activeTransitions = append(s.activeTransitions, *rec.Transition)
+		}
+	}
+}
+
+// segmentBatch is records encoded for one write to the newest segment.
+type segmentBatch struct {
+	seq   int
+	base  int64
+	buf   bytes.Buffer
+	lines []indexLine
+}
+
+// add encodes rec and returns the position it will have once written.
+func (b *segmentBatch) add(rec Record) (Position, error) {
+	pos := Position{Segment: b.seq, Offset: b.base + int64(b.buf.Len())}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return pos, err
+	}
+	b.buf.Write(line)
+	b.buf.WriteByte('\n')
+	b.lines = append(b.lines, indexLine{Offset: pos.Offset, Sum: dataSum(rec), Record: rec})
+	return pos, nil
+}
+
+// newBatch starts a batch for the newest segment, first sealing it and
+// starting another if it has filled up.
+func (s *SegmentLog) newBatch() (*segmentBatch, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	if s.activeSize >= s.maxSegmentSize {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return &segmentBatch{seq: s.activeSeq, base: s.activeSize}, nil
+}
+
+// commit writes a batch to the newest segment and syncs it. If either fails
+// the segment is cut back to where it was, so a batch is stored whole or
+// not at all.
+func (s *SegmentLog) commit(b *segmentBatch) error {
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	_, err := s.active.Write(b.buf.Bytes())
+	if err == nil {
+		err = s.active.Sync()
+	}
+	if err != nil {
+		if _, seekErr := s.active.Seek(s.activeSize, io.SeekStart); seekErr != nil {
+			return errors.Join(err, seekErr)
+		}
+		return errors.Join(err, s.active.Truncate(s.activeSize))
+	}
+	for _, line := range b.lines {
+		s.apply(line, b.seq)
+	}
+	s.activeSize += int64(b.buf.Len())
+	return nil
+}
+
+// append writes records to the newest segment as one batch.
+func (s *SegmentLog) append(recs ...Record) error {
+	b, err := s.newBatch()
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if _, err := b.add(rec); err != nil {
+			return err
+		}
+	}
+	return s.commit(b)
+}
+
+func (s *SegmentLog) rotate() error {
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+	lines, err := scanIndex(segmentPath(s.dir, s.activeSeq))
+	if err != nil {
+		return err
+	}
+	if err := writeIndex(indexPath(s.dir, s.activeSeq), lines); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(segmentPath(s.dir, s.activeSeq+1), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	s.active = f
+	s.activeSeq++
+	s.activeSize = 0
+	s.activeTransitions = nil
+	return nil
+}
+
+// read returns the record at pos.
+func (s *SegmentLog) read(pos Position) (Record, error) {
+	f, ok := s.readers[pos.Segment]
+	if !ok {
+		var err error
+		if f, err = os.Open(segmentPath(s.dir, pos.Segment)); err != nil {
+			return Record{}, err
+		}
+		s.readers[pos.Segment] = f
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(f, pos.Offset, 1<<62)).ReadBytes('\n')
+	if err != nil {
+		return Record{}, fmt.Errorf("segment %d offset %d: %w", pos.Segment, pos.Offset, err)
+	}
+	var rec Record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return Record{}, fmt.Errorf("segment %d offset %d: %w", pos.Segment, pos.Offset, err)
+	}
+	return rec, nil
+}
+
+func (s *SegmentLog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, f := range s.readers {
+		errs = append(errs, f.Close())
+	}
+	if s.active != nil {
+		errs = append(errs, s.active.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *SegmentLog) ItemIDRanges() ([]model.ItemIDRange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]model.ItemID, 0, len(s.items))
+	for id := range s.items {
+		ids = append(ids, id)
+	}
+	return idRanges(ids), nil
+}
+
+// WriteItemBatch appends a batch of item revisions and their transitions in
+// one write. A revision byte-identical to the item's latest one, once
+// compacted, is appended only as an observation.
+func (s *SegmentLog) WriteItemBatch(updates []model.ItemUpdate, transitions []model.Transition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.newBatch()
+	if err != nil {
+		return err
+	}
+	// heads holds the heads of the items written in this batch.
+	heads := make(map[model.ItemID]itemHead)
+	for _, update := range updates {
+		var data bytes.Buffer
+		if err := json.Compact(&data, update.Data); err != nil {
+			return fmt.Errorf("item %d: %w", update.ID, err)
+		}
+		rec := Record{Type: RecordItem, RxTime: update.RxTime, ItemID: update.ID, Data: data.Bytes()}
+		sum := sha256.Sum256(rec.Data)
+		head, ok := heads[update.ID]
+		if !ok {
+			head, ok = s.items[update.ID]
+		}
+		if ok && head.sum == sum {
+			pos := head.pos
+			rec = Record{Type: RecordObserved, RxTime: update.RxTime, ItemID: update.ID, Same: &pos}
+		}
+		if ok {
+			prev := head.last
+			rec.Prev = &prev
+		}
+		pos, err := b.add(rec)
+		if err != nil {
+			return err
+		}
+		if rec.Type == RecordItem && (!ok || !rec.RxTime.Before(head.rx)) {
+			head.revisionEntry = revisionEntry{rx: rec.RxTime, pos: pos}
+			head.sum = sum
+		}
+		head.last = pos
+		heads[update.ID] = head
+	}
+	cleared := make(map[model.ItemID]bool)
+	for _, update := range updates {
+		if _, ok := s.failed[update.ID]; ok && !cleared[update.ID] {
+			cleared[update.ID] = true
+			if _, err := b.add(Record{Type: RecordCleared, RxTime: update.RxTime, ItemID: update.ID}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rec := range transitionRecords(transitions) {
+		if _, err := b.add(rec); err != nil {
+			return err
+		}
+	}
+	return s.commit(b)
+}
+
+// walkItem calls fn with every record of an item, newest first: those the
+// links reach back from its newest record, then those written before
+// records were linked.
+func (s *SegmentLog) walkItem(id model.ItemID, fn func(Record)) error {
+	head, ok := s.items[id]
+	if !ok {
+		return nil
+	}
+	unlinked := s.unlinkedItems[id]
+	var seen map[Position]bool
+	if len(unlinked) > 0 {
+		seen = make(map[Position]bool)
+	}
+	for pos := &head.last; pos != nil; {
+		rec, err := s.read(*pos)
+		if err != nil {
+			return err
+		}
+		if seen != nil {
+			seen[*pos] = true
+		}
+		fn(rec)
+		pos = rec.Prev
+	}
+	for i := len(unlinked) - 1; i >= 0; i-- {
+		if seen[unlinked[i]] {
+			continue
+		}
+		rec, err := s.read(unlinked[i])
+		if err != nil {
+			return err
+		}
+		fn(rec)
+	}
+	return nil
+}
+
+// itemAt returns the revision of an item with the greatest receive time not
+// after at, or its latest if at is zero. Only a time before the latest
+// revision follows the item's links.
+func (s *SegmentLog) itemAt(id model.ItemID, at time.Time) (*model.Item, error) {
+	head, ok := s.items[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var rec Record
+	found := false
+	if at.IsZero() || !head.rx.After(at) {
+		var err error
+		if rec, err = s.read(head.pos); err != nil {
+			return nil, err
+		}
+		found = true
+	} else {
+		err := s.walkItem(id, func(r Record) {
+			if r.Type == RecordItem && !r.RxTime.After(at) && (!found || r.RxTime.After(rec.RxTime)) {
+				rec, found = r, true
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	var item model.Item
+	if err := json.Unmarshal(rec.Data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (s *SegmentLog) GetLatestItem(id model.ItemID) (*model.Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.itemAt(id, time.Time{})
+}
+
+func (s *SegmentLog) GetItemAt(id model.ItemID, at time.Time) (*model.Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.itemAt(id, at)
+}
+
+func (s *SegmentLog) LatestItems(ids []model.ItemID) (map[model.ItemID]*model.Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make(map[model.ItemID]*model.Item, len(ids))
+	for _, id := range ids {
+		item, err := s.itemAt(id, time.Time{})
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items[id] = item
+	}
+	return items, nil
+}
+
+func (s *SegmentLog) ItemObservedTimes(id model.ItemID) ([]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var times []time.Time
+	err := s.walkItem(id, func(rec Record) {
+		times = append(times, rec.RxTime)
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(times, time.Time.Compare)
+	return times, nil
+}
+
+func (s *SegmentLog) WriteUserBatch(updates []model.UserUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recs := make([]Record, len(updates))
+	for i, update := range updates {
+		recs[i] = Record{Type: RecordUser, RxTime: update.RxTime, UserID: update.ID, Data: update.Data}
+	}
+	return s.append(recs...)
+}
+
+func (s *SegmentLog) GetLatestUser(id model.UserID) (*model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	rec, err := s.read(last.pos)
+	if err != nil {
+		return nil, err
+	}
+	var user model.User
+	if err := json.Unmarshal(rec.Data, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *SegmentLog) WriteList(listUpdate model.ListUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := Record{Type: RecordList, RxTime: listUpdate.RxTime, List: listUpdate.ID, Data: listUpdate.Data}
+	if head, ok := s.lists[listUpdate.ID]; ok {
+		prev := head.last.pos
+		rec.Prev = &prev
+	}
+	return s.append(rec)
+}
+
+func (s *SegmentLog) GetList(name model.ListName) (*model.StoryList, error) {
+	return s.GetListAt(name, time.Time{})
+}
+
+func (s *SegmentLog) GetListAt(name model.ListName, at time.Time) (*model.StoryList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	head, ok := s.lists[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var rec Record
+	var err error
+	if at.IsZero() || !head.rx.After(at) {
+		rec, err = s.read(head.pos)
+	} else {
+		rec, ok, err = s.listAt(name, at)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if rec.Data == nil || string(rec.Data) == "null" {
+		return nil, nil
+	}
+	var list model.StoryList
+	if err := json.Unmarshal(rec.Data, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// listAt finds the revision of a list with the greatest receive time not
+// after at. Lists are written in the order they are received, so it is in
+// the newest segment whose first revision of the list is not after at, and
+// only that segment's links are followed.
+func (s *SegmentLog) listAt(name model.ListName, at time.Time) (Record, bool, error) {
+	var best Record
+	found := false
+	for seq := s.activeSeq; seq > 0; seq-- {
+		summary := s.summaries[seq]
+		if summary == nil {
+			continue
+		}
+		span, ok := summary.lists[name]
+		if !ok || span.first.After(at) {
+			continue
+		}
+		for pos := &span.last; pos != nil && pos.Segment == seq; {
+			rec, err := s.read(*pos)
+			if err != nil {
+				return Record{}, false, err
+			}
+			if !rec.RxTime.After(at) && (!found || rec.RxTime.After(best.RxTime)) {
+				best, found = rec, true
+			}
+			pos = rec.Prev
+		}
+		break
+	}
+	if entry, ok := latestEntry(s.unlinkedLists[name], at); ok && (!found || entry.rx.After(best.RxTime)) {
+		rec, err := s.read(entry.pos)
+		if err != nil {
+			return Record{}, false, err
+		}
+		best, found = rec, true
+	}
+	return best, found, nil
+}
+
+func (s *SegmentLog) GetFailedFetch(id model.ItemID) (*model.FailedFetch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.failed[id]
+	if !ok {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+func (s *SegmentLog) PutFailedFetch(f model.FailedFetch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(Record{Type: RecordFailed, RxTime: f.LastFailedAt, ItemID: f.ItemID, FailedFetch: &f})
+}
+
+func (s *SegmentLog) DueFailedFetches(now time.Time, limit int) ([]model.FailedFetch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return dueFailedFetches(s.failed, now, limit), nil
+}
+
+func (s *SegmentLog) FailedFetches() ([]model.FailedFetch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return allFailedFetches(s.failed), nil
+}
+
+func transitionRecords(transitions []model.Transition) []Record {
+	recs := make([]Record, len(transitions))
+	for i := range transitions {
+		recs[i] = Record{Type: RecordTransition, RxTime: transitions[i].At, ItemID: transitions[i].ItemID, Transition: &transitions[i]}
+	}
+	return recs
+}
+
+func (s *SegmentLog) WriteTransitions(transitions []model.Transition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(transitionRecords(transitions)...)
+}
+
+func (s *SegmentLog) GetTransitions(from, to time.Time) ([]model.Transition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []model.Transition
+	for seq := 1; seq < s.activeSeq; seq++ {
+		summary := s.summaries[seq]
+		if summary == nil || summary.transitions == 0 || summary.lastTransition.Before(from) || !summary.firstTransition.Before(to) {
+			continue
+		}
+		lines, err := s.sealedIndex(seq)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", seq, err)
+		}
+		for _, line := range lines {
+			if line.Type == RecordTransition {
+				all = append(all, *line.Transition)
+			}
+		}
+	}
+	all = append(all, s.activeTransitions...)
+	return transitionsIn(all, from, to), nil
+}
+
+// Replay calls fn with every record in the log, oldest segment first. The
+// Data of an observation is filled in from the revision it matched.
+func (s *SegmentLog) Replay(fn func(Record) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for seq := 1; seq <= s.activeSeq; seq++ {
+		path := segmentPath(s.dir, seq)
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		_, err := scanSegment(path, func(rec Record, off int64) error {
+			if rec.Type == RecordObserved {
+				same, err := s.read(*rec.Same)
+				if err != nil {
+					return err
+				}
+				rec.Data = same.Data
+			}
+			return fn(rec)
+		})
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", seq, err)
+		}
+	}
+	return nil
+}
+
+// Rebuild replays the whole log into dst, which should start out empty.
+func (s *SegmentLog) Rebuild(dst EventLog, batchSize int) error {
+	var items []model.ItemUpdate
+	var users []model.UserUpdate
+	flush := func() error {
+		if len(items) > 0 {
+			if err := dst.WriteItemBatch(items, nil); err != nil {
+				return err
+			}
+			items = items[:0]
+		}
+		if len(users) > 0 {
+			if err := dst.WriteUserBatch(users); err != nil {
+				return err
+			}
+			users = users[:0]
+		}
+		return nil
+	}
+	err := s.Replay(func(rec Record) error {
+		switch rec.Type {
+		case RecordItem, RecordObserved:
+			items = append(items, model.ItemUpdate{RxTime: rec.RxTime, ID: rec.ItemID, Data: rec.Data})
+		case RecordUser:
+			users = append(users, model.UserUpdate{RxTime: rec.RxTime, ID: rec.UserID, Data: rec.Data})
+		default:
+			// Keep failures, clears and transitions ordered against the
+			// item writes around them.
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		switch rec.Type {
+		case RecordList:
+			return dst.WriteList(model.ListUpdate{RxTime: rec.RxTime, ID: rec.List, Data: rec.Data})
+		case RecordFailed:
+			return dst.PutFailedFetch(*rec.FailedFetch)
+		case RecordTransition:
+			return dst.WriteTransitions([]model.Transition{*rec.Transition})
+		}
+		if len(items) >= batchSize || len(users) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
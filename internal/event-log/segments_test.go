@@ -0,0 +1,289 @@
+package eventlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+func TestSegmentLogReopenAndRebuild(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.maxSegmentSize = 200
+
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 10; i++ {
+		data := json.RawMessage(fmt.Sprintf(`{"id": %d, "type": "comment"}`, i))
+		batch := []model.ItemUpdate{
+			{RxTime: t0, ID: model.ItemID(i), Data: data},
+			{RxTime: t0.Add(time.Minute), ID: model.ItemID(i), Data: data},
+		}
+		if err := s.WriteItemBatch(batch, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.WriteList(model.ListUpdate{RxTime: t0, ID: model.ListTop, Data: json.RawMessage("[3,1]")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	seqs, err := segments(dir)
+	if err != nil || len(seqs) < 3 {
+		t.Fatalf("segments = %v, %v, want several", seqs, err)
+	}
+	if _, err := os.Stat(indexPath(dir, seqs[0])); err != nil {
+		t.Errorf("sealed segment has no index: %v", err)
+	}
+	// A crash mid-write leaves a torn record at the end.
+	active, err := os.OpenFile(segmentPath(dir, seqs[len(seqs)-1]), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active.WriteString(`{"type":"item","rx":`)
+	active.Close()
+
+	s, err = OpenSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ranges, err := s.ItemIDRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprint([]model.ItemIDRange{{Lo: 1, Hi: 10}}); fmt.Sprint(ranges) != want {
+		t.Errorf("ranges after reopen = %v, want %s", ranges, want)
+	}
+	item, err := s.GetLatestItem(7)
+	if err != nil || item.ID != 7 {
+		t.Errorf("GetLatestItem(7) = %v, %v", item, err)
+	}
+	if err := s.WriteItemBatch([]model.ItemUpdate{{RxTime: t0.Add(2 * time.Minute), ID: 11, Data: json.RawMessage(`{"id":11}`)}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewMemoryLog()
+	if err := s.Rebuild(dst, 4); err != nil {
+		t.Fatal(err)
+	}
+	if len(dst.items) != 11 {
+		t.Errorf("rebuilt %d items, want 11", len(dst.items))
+	}
+	for id, revs := range dst.items {
+		wantObserved := 1
+		if id == 11 {
+			wantObserved = 0
+		}
+		if len(revs) != 1 || len(dst.observations[id]) != wantObserved {
+			t.Errorf("item %d rebuilt with %d revisions and %d observations", id, len(revs), len(dst.observations[id]))
+		}
+	}
+	if list, err := dst.GetList(model.ListTop); err != nil || len(*list) != 2 {
+		t.Errorf("rebuilt top list = %v, %v", list, err)
+	}
+}
+
+func TestSegmentLogReadOnly(t *testing.T) {
+	if _, err := OpenSegmentsReadOnly(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("OpenSegmentsReadOnly succeeded on a missing directory")
+	}
+
+	dir := t.TempDir()
+	s, err := OpenSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := model.ItemUpdate{RxTime: time.Now(), ID: 1, Data: json.RawMessage(`{"id":1,"title":"A"}`)}
+	if err := s.WriteItemBatch([]model.ItemUpdate{update}, nil); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	path := segmentPath(dir, 1)
+	torn, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn.WriteString(`{"type":"item","rx":`)
+	torn.Close()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := OpenSegmentsReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if item, err := ro.GetLatestItem(1); err != nil || *item.Title != "A" {
+		t.Errorf("GetLatestItem(1) = %v, %v", item, err)
+	}
+	if err := ro.WriteItemBatch([]model.ItemUpdate{update}, nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("WriteItemBatch on a read-only log: err = %v, want ErrReadOnly", err)
+	}
+	if after, err := os.ReadFile(path); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("opening read-only changed the segment: %q, %v", after, err)
+	}
+}
+
+func TestSegmentLogBatchIsAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	batch := []model.ItemUpdate{
+		{RxTime: t0, ID: 1, Data: json.RawMessage(`{"id":1}`)},
+		{RxTime: t0, ID: 2, Data: json.RawMessage(`{"id":`)},
+	}
+	if err := s.WriteItemBatch(batch, nil); err == nil {
+		t.Fatal("WriteItemBatch succeeded with a malformed item")
+	}
+	if _, err := s.GetLatestItem(1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetLatestItem(1) after a failed batch: err = %v, want ErrNotFound", err)
+	}
+	if info, err := os.Stat(segmentPath(dir, 1)); err != nil || info.Size() != 0 {
+		t.Errorf("segment after a failed batch = %v, %v, want it empty", info, err)
+	}
+
+	// A revision repeated within a batch is stored once.
+	batch = []model.ItemUpdate{
+		{RxTime: t0, ID: 1, Data: json.RawMessage(`{"id":1}`)},
+		{RxTime: t0.Add(time.Minute), ID: 1, Data: json.RawMessage(`{"id": 1}`)},
+	}
+	if err := s.WriteItemBatch(batch, nil); err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[RecordType]int)
+	if _, err := scanSegment(segmentPath(dir, 1), func(rec Record, off int64) error {
+		kinds[rec.Type]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if kinds[RecordItem] != 1 || kinds[RecordObserved] != 1 {
+		t.Errorf("item 1 has %d revisions and %d observations, want 1 and 1", kinds[RecordItem], kinds[RecordObserved])
+	}
+}
+
+func TestSegmentLogHistoryAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.maxSegmentSize = 300
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	const revisions = 6
+	for i := 0; i < revisions; i++ {
+		at := t0.Add(time.Duration(i) * time.Minute)
+		batch := []model.ItemUpdate{
+			{RxTime: at, ID: 1, Data: json.RawMessage(fmt.Sprintf(`{"id":1,"score":%d}`, i))},
+			{RxTime: at, ID: 2, Data: json.RawMessage(`{"id":2}`)},
+		}
+		transitions := []model.Transition{{ItemID: 1, Kind: "score", At: at, Before: fmt.Sprint(i - 1), After: fmt.Sprint(i)}}
+		if err := s.WriteItemBatch(batch, transitions); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteList(model.ListUpdate{RxTime: at, ID: model.ListTop, Data: json.RawMessage(fmt.Sprintf("[1,%d]", i+10))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if seqs, err := segments(dir); err != nil || len(seqs) < 3 {
+		t.Fatalf("segments = %v, %v, want several", seqs, err)
+	}
+
+	s, err = OpenSegmentsReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < revisions; i++ {
+		at := t0.Add(time.Duration(i)*time.Minute + 30*time.Second)
+		if item, err := s.GetItemAt(1, at); err != nil || item.Score == nil || *item.Score != i {
+			t.Errorf("GetItemAt(1, %v) = %+v, %v, want score %d", at, item, err, i)
+		}
+		if list, err := s.GetListAt(model.ListTop, at); err != nil || fmt.Sprint(*list) != fmt.Sprint(model.StoryList{1, model.ItemID(i + 10)}) {
+			t.Errorf("GetListAt(%v) = %v, %v", at, list, err)
+		}
+	}
+	if _, err := s.GetItemAt(1, t0.Add(-time.Second)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetItemAt before the first revision: err = %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetListAt(model.ListTop, t0.Add(-time.Second)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetListAt before the first revision: err = %v, want ErrNotFound", err)
+	}
+	if times, err := s.ItemObservedTimes(2); err != nil || len(times) != revisions || !times[revisions-1].Equal(t0.Add((revisions-1)*time.Minute)) {
+		t.Errorf("ItemObservedTimes(2) = %v, %v", times, err)
+	}
+	transitions, err := s.GetTransitions(t0.Add(time.Minute), t0.Add(4*time.Minute))
+	if err != nil || len(transitions) != 3 {
+		t.Fatalf("GetTransitions = %v, %v, want 3", transitions, err)
+	}
+	for i, tr := range transitions {
+		if want := t0.Add(time.Duration(i+1) * time.Minute); !tr.At.Equal(want) {
+			t.Errorf("transition %d at %v, want %v", i, tr.At, want)
+		}
+	}
+}
+
+func TestSegmentLogReadsUnlinkedRecords(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// A segment written before records linked back to the previous one.
+	var old bytes.Buffer
+	encoder := json.NewEncoder(&old)
+	for i, rec := range []Record{
+		{Type: RecordItem, RxTime: t0, ItemID: 1, Data: json.RawMessage(`{"id":1,"score":0}`)},
+		{Type: RecordList, RxTime: t0, List: model.ListTop, Data: json.RawMessage(`[1]`)},
+		{Type: RecordItem, RxTime: t0.Add(time.Minute), ItemID: 1, Data: json.RawMessage(`{"id":1,"score":1}`)},
+		{Type: RecordList, RxTime: t0.Add(time.Minute), List: model.ListTop, Data: json.RawMessage(`[1,2]`)},
+	} {
+		if err := encoder.Encode(rec); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if err := os.WriteFile(segmentPath(dir, 1), old.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.WriteItemBatch([]model.ItemUpdate{{RxTime: t0.Add(2 * time.Minute), ID: 1, Data: json.RawMessage(`{"id":1,"score":2}`)}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteList(model.ListUpdate{RxTime: t0.Add(2 * time.Minute), ID: model.ListTop, Data: json.RawMessage(`[1,2,3]`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		at := t0.Add(time.Duration(i)*time.Minute + time.Second)
+		if item, err := s.GetItemAt(1, at); err != nil || *item.Score != i {
+			t.Errorf("GetItemAt(1, %v) = %+v, %v, want score %d", at, item, err, i)
+		}
+		if list, err := s.GetListAt(model.ListTop, at); err != nil || len(*list) != i+1 {
+			t.Errorf("GetListAt(%v) = %v, %v", at, list, err)
+		}
+	}
+	if times, err := s.ItemObservedTimes(1); err != nil || len(times) != 3 {
+		t.Errorf("ItemObservedTimes(1) = %v, %v, want 3 times", times, err)
+	}
+}
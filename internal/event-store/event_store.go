@@ -1,6 +1,12 @@
 package eventstore
 
-import "github.com/dan-mcdonald/fasthacker/internal/model"
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
 
 type GetItemResponse struct {
 	Item *model.Item
@@ -12,37 +18,168 @@ type GetItemRequest struct {
 	Resp chan GetItemResponse
 }
 
-type GetTopStoriesResponse struct {
-	TopStories *model.TopStories
-	Err        error
+// GetItemAtRequest asks for an item as it was at At.
+type GetItemAtRequest struct {
+	ID   model.ItemID
+	At   time.Time
+	Resp chan GetItemResponse
+}
+
+type GetUserResponse struct {
+	User *model.User
+	Err  error
+}
+
+type GetUserRequest struct {
+	ID   model.UserID
+	Resp chan GetUserResponse
+}
+
+type GetListResponse struct {
+	List *model.StoryList
+	Err  error
+}
+
+type GetListRequest struct {
+	Name model.ListName
+	Resp chan GetListResponse
 }
 
-type GetTopStoriesRequest struct {
-	Resp chan GetTopStoriesResponse
+// GetListAtRequest asks for a list as it was at At.
+type GetListAtRequest struct {
+	Name model.ListName
+	At   time.Time
+	Resp chan GetListResponse
+}
+
+type GetFailedFetchesResponse struct {
+	FailedFetches []model.FailedFetch
+	Err           error
+}
+
+type GetFailedFetchesRequest struct {
+	Resp chan GetFailedFetchesResponse
+}
+
+type GetTransitionsResponse struct {
+	Transitions []model.Transition
+	Err         error
+}
+
+// GetTransitionsRequest asks for the transitions recorded in [From, To).
+// Transitions are found when their items are written, so those of items
+// still waiting in a batch are not included yet.
+type GetTransitionsRequest struct {
+	From time.Time
+	To   time.Time
+	Resp chan GetTransitionsResponse
 }
 
 type EventStore struct {
-	GetItemReq       chan GetItemRequest
-	GetTopStoriesReq chan GetTopStoriesRequest
+	GetItemReq          chan GetItemRequest
+	GetItemAtReq        chan GetItemAtRequest
+	GetUserReq          chan GetUserRequest
+	GetListReq          chan GetListRequest
+	GetListAtReq        chan GetListAtRequest
+	GetFailedFetchesReq chan GetFailedFetchesRequest
+	GetTransitionsReq   chan GetTransitionsRequest
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
+// ErrClosed is returned by requests made once nothing answers them anymore.
+var ErrClosed = errors.New("event store closed")
+
 func NewEventStore() *EventStore {
 	return &EventStore{
-		GetItemReq:       make(chan GetItemRequest),
-		GetTopStoriesReq: make(chan GetTopStoriesRequest),
+		GetItemReq:          make(chan GetItemRequest),
+		GetItemAtReq:        make(chan GetItemAtRequest),
+		GetUserReq:          make(chan GetUserRequest),
+		GetListReq:          make(chan GetListRequest),
+		GetListAtReq:        make(chan GetListAtRequest),
+		GetFailedFetchesReq: make(chan GetFailedFetchesRequest),
+		GetTransitionsReq:   make(chan GetTransitionsRequest),
+		done:                make(chan struct{}),
+	}
+}
+
+// Close is called by whatever answers requests when it stops doing so.
+// Requests pending or made after it fail with ErrClosed.
+func (es *EventStore) Close() {
+	es.closeOnce.Do(func() { close(es.done) })
+}
+
+// send hands req to whatever answers requests on ch. A request that is
+// taken is always answered.
+func send[T any](es *EventStore, ch chan<- T, req T) error {
+	select {
+	case ch <- req:
+		return nil
+	case <-es.done:
+		return ErrClosed
 	}
 }
 
 func (es *EventStore) GetLatestItem(id model.ItemID) (*model.Item, error) {
 	respCh := make(chan GetItemResponse)
-	es.GetItemReq <- GetItemRequest{ID: id, Resp: respCh}
+	if err := send(es, es.GetItemReq, GetItemRequest{ID: id, Resp: respCh}); err != nil {
+		return nil, err
+	}
 	resp := <-respCh
 	return resp.Item, resp.Err
 }
 
-func (es *EventStore) GetTopStories() (*model.TopStories, error) {
-	respCh := make(chan GetTopStoriesResponse)
-	es.GetTopStoriesReq <- GetTopStoriesRequest{Resp: respCh}
+func (es *EventStore) GetItemAt(id model.ItemID, at time.Time) (*model.Item, error) {
+	respCh := make(chan GetItemResponse)
+	if err := send(es, es.GetItemAtReq, GetItemAtRequest{ID: id, At: at, Resp: respCh}); err != nil {
+		return nil, err
+	}
+	resp := <-respCh
+	return resp.Item, resp.Err
+}
+
+func (es *EventStore) GetLatestUser(id model.UserID) (*model.User, error) {
+	respCh := make(chan GetUserResponse)
+	if err := send(es, es.GetUserReq, GetUserRequest{ID: id, Resp: respCh}); err != nil {
+		return nil, err
+	}
+	resp := <-respCh
+	return resp.User, resp.Err
+}
+
+func (es *EventStore) GetList(name model.ListName) (*model.StoryList, error) {
+	respCh := make(chan GetListResponse)
+	if err := send(es, es.GetListReq, GetListRequest{Name: name, Resp: respCh}); err != nil {
+		return nil, err
+	}
+	resp := <-respCh
+	return resp.List, resp.Err
+}
+
+func (es *EventStore) GetListAt(name model.ListName, at time.Time) (*model.StoryList, error) {
+	respCh := make(chan GetListResponse)
+	if err := send(es, es.GetListAtReq, GetListAtRequest{Name: name, At: at, Resp: respCh}); err != nil {
+		return nil, err
+	}
+	resp := <-respCh
+	return resp.List, resp.Err
+}
+
+func (es *EventStore) GetFailedFetches() ([]model.FailedFetch, error) {
+	respCh := make(chan GetFailedFetchesResponse)
+	if err := send(es, es.GetFailedFetchesReq, GetFailedFetchesRequest{Resp: respCh}); err != nil {
+		return nil, err
+	}
+	resp := <-respCh
+	return resp.FailedFetches, resp.Err
+}
+
+func (es *EventStore) GetTransitions(from, to time.Time) ([]model.Transition, error) {
+	respCh := make(chan GetTransitionsResponse)
+	if err := send(es, es.GetTransitionsReq, GetTransitionsRequest{From: from, To: to, Resp: respCh}); err != nil {
+		return nil, err
+	}
 	resp := <-respCh
-	return resp.TopStories, resp.Err
+	return resp.Transitions, resp.Err
 }
@@ -0,0 +1,52 @@
+package eventstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+// Reader is the read side of an event log.
+type Reader interface {
+	GetLatestItem(id model.ItemID) (*model.Item, error)
+	GetItemAt(id model.ItemID, at time.Time) (*model.Item, error)
+	GetLatestUser(id model.UserID) (*model.User, error)
+	GetList(name model.ListName) (*model.StoryList, error)
+	GetListAt(name model.ListName, at time.Time) (*model.StoryList, error)
+	FailedFetches() ([]model.FailedFetch, error)
+	GetTransitions(from, to time.Time) ([]model.Transition, error)
+}
+
+// Serve answers requests on es by querying r directly, until ctx is done.
+// It is for serving an event log that nothing is writing to.
+func (es *EventStore) Serve(ctx context.Context, r Reader) {
+	defer es.Close()
+	for {
+		select {
+		case req := <-es.GetItemReq:
+			item, err := r.GetLatestItem(req.ID)
+			req.Resp <- GetItemResponse{Item: item, Err: err}
+		case req := <-es.GetItemAtReq:
+			item, err := r.GetItemAt(req.ID, req.At)
+			req.Resp <- GetItemResponse{Item: item, Err: err}
+		case req := <-es.GetUserReq:
+			user, err := r.GetLatestUser(req.ID)
+			req.Resp <- GetUserResponse{User: user, Err: err}
+		case req := <-es.GetListReq:
+			list, err := r.GetList(req.Name)
+			req.Resp <- GetListResponse{List: list, Err: err}
+		case req := <-es.GetListAtReq:
+			list, err := r.GetListAt(req.Name, req.At)
+			req.Resp <- GetListResponse{List: list, Err: err}
+		case req := <-es.GetFailedFetchesReq:
+			failures, err := r.FailedFetches()
+			req.Resp <- GetFailedFetchesResponse{FailedFetches: failures, Err: err}
+		case req := <-es.GetTransitionsReq:
+			transitions, err := r.GetTransitions(req.From, req.To)
+			req.Resp <- GetTransitionsResponse{Transitions: transitions, Err: err}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package eventstoredataloader
 
 import (
+	"time"
+
 	eventstore "github.com/dan-mcdonald/fasthacker/internal/event-store"
 	"github.com/dan-mcdonald/fasthacker/internal/model"
 )
@@ -13,12 +15,12 @@ func NewEventStoreDataLoader(es *eventstore.EventStore) *EventStoreDataLoader {
 	return &EventStoreDataLoader{es: es}
 }
 
-func (esdl *EventStoreDataLoader) GetTopStories() (model.TopStories, error) {
-	item, err := esdl.es.GetTopStories()
+func (esdl *EventStoreDataLoader) GetList(name model.ListName) (model.StoryList, error) {
+	list, err := esdl.es.GetList(name)
 	if err != nil {
-		return model.TopStories{}, err
+		return model.StoryList{}, err
 	}
-	return *item, nil
+	return *list, nil
 }
 
 func (esdl *EventStoreDataLoader) GetItem(id model.ItemID) (model.Item, error) {
@@ -29,6 +31,30 @@ func (esdl *EventStoreDataLoader) GetItem(id model.ItemID) (model.Item, error) {
 	return *item, nil
 }
 
+func (esdl *EventStoreDataLoader) GetListAt(name model.ListName, at time.Time) (model.StoryList, error) {
+	list, err := esdl.es.GetListAt(name, at)
+	if err != nil {
+		return model.StoryList{}, err
+	}
+	return *list, nil
+}
+
+func (esdl *EventStoreDataLoader) GetItemAt(id model.ItemID, at time.Time) (model.Item, error) {
+	item, err := esdl.es.GetItemAt(id, at)
+	if err != nil {
+		return model.Item{}, err
+	}
+	return *item, nil
+}
+
+func (esdl *EventStoreDataLoader) GetUser(id model.UserID) (model.User, error) {
+	user, err := esdl.es.GetLatestUser(id)
+	if err != nil {
+		return model.User{}, err
+	}
+	return *user, nil
+}
+
 func (esdl *EventStoreDataLoader) GetComment(id model.ItemID) (model.Item, error) {
 	item, err := esdl.es.GetLatestItem(id)
 	if err != nil {
@@ -36,3 +62,7 @@ func (esdl *EventStoreDataLoader) GetComment(id model.ItemID) (model.Item, error
 	}
 	return *item, nil
 }
+
+func (esdl *EventStoreDataLoader) GetFailedFetches() ([]model.FailedFetch, error) {
+	return esdl.es.GetFailedFetches()
+}
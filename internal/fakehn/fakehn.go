@@ -0,0 +1,216 @@
+package fakehn
+
+// Fake of the Hacker News Firebase API backed by an in-memory fixture set.
+// Serves the REST endpoints as plain JSON and, when the client asks for
+// text/event-stream, the same documents as Firebase SSE "put" events.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+type Fixtures struct {
+	Items   map[model.ItemID]json.RawMessage
+	Users   map[model.UserID]json.RawMessage
+	MaxItem model.ItemID
+	Lists   map[model.ListName]model.StoryList
+}
+
+type updates struct {
+	Items    []model.ItemID `json:"items"`
+	Profiles []model.UserID `json:"profiles"`
+}
+
+type putMessage struct {
+	Path string `json:"path"`
+	Data any    `json:"data"`
+}
+
+type Server struct {
+	KeepAlive time.Duration
+
+	mu          sync.Mutex
+	fixtures    Fixtures
+	updates     updates
+	subscribers map[string]map[chan []byte]struct{}
+}
+
+func NewServer(fixtures Fixtures) *Server {
+	if fixtures.Items == nil {
+		fixtures.Items = make(map[model.ItemID]json.RawMessage)
+	}
+	if fixtures.Users == nil {
+		fixtures.Users = make(map[model.UserID]json.RawMessage)
+	}
+	if fixtures.Lists == nil {
+		fixtures.Lists = make(map[model.ListName]model.StoryList)
+	}
+	for id := range fixtures.Items {
+		if id > fixtures.MaxItem {
+			fixtures.MaxItem = id
+		}
+	}
+	return &Server{
+		KeepAlive:   30 * time.Second,
+		fixtures:    fixtures,
+		subscribers: make(map[string]map[chan []byte]struct{}),
+	}
+}
+
+// SetItem stores an item, bumps maxitem if needed and announces both.
+func (s *Server) SetItem(id model.ItemID, data json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fixtures.Items[id] = data
+	if id > s.fixtures.MaxItem {
+		s.fixtures.MaxItem = id
+		s.publishLocked("maxitem", s.fixtures.MaxItem)
+	}
+}
+
+func (s *Server) SetUser(id model.UserID, data json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fixtures.Users[id] = data
+}
+
+func (s *Server) SetList(name model.ListName, list model.StoryList) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fixtures.Lists[name] = list
+	s.publishLocked(string(name), list)
+}
+
+// PublishUpdate replaces the updates document and pushes it to subscribers.
+func (s *Server) PublishUpdate(itemIDs []model.ItemID, userIDs []model.UserID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates = updates{Items: itemIDs, Profiles: userIDs}
+	s.publishLocked("updates", s.updates)
+}
+
+func (s *Server) publishLocked(stream string, data any) {
+	msg, err := encodePut(data)
+	if err != nil {
+		panic(err)
+	}
+	for ch := range s.subscribers[stream] {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+func encodePut(data any) ([]byte, error) {
+	payload, err := json.Marshal(putMessage{Path: "/", Data: data})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("event: put\ndata: %s\n\n", payload)), nil
+}
+
+// document returns the current JSON document for a path relative to the
+// API root, or false if the path is not one we serve.
+func (s *Server) document(path string) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case path == "maxitem.json":
+		return s.fixtures.MaxItem, true
+	case path == "updates.json":
+		return s.updates, true
+	case strings.HasPrefix(path, "item/") && strings.HasSuffix(path, ".json"):
+		id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(path, "item/"), ".json"), 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		if data, ok := s.fixtures.Items[model.ItemID(id)]; ok {
+			return data, true
+		}
+		return nil, true
+	case strings.HasPrefix(path, "user/") && strings.HasSuffix(path, ".json"):
+		id := model.UserID(strings.TrimSuffix(strings.TrimPrefix(path, "user/"), ".json"))
+		if data, ok := s.fixtures.Users[id]; ok {
+			return data, true
+		}
+		return nil, true
+	}
+	for _, name := range model.StoryLists {
+		if path == string(name)+".json" {
+			if list, ok := s.fixtures.Lists[name]; ok {
+				return list, true
+			}
+			return model.StoryList{}, true
+		}
+	}
+	return nil, false
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	doc, ok := s.document(path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Accept") == "text/event-stream" {
+		s.serveStream(w, r, strings.TrimSuffix(path, ".json"), doc)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(doc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request, stream string, doc any) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan []byte, 16)
+	s.mu.Lock()
+	if s.subscribers[stream] == nil {
+		s.subscribers[stream] = make(map[chan []byte]struct{})
+	}
+	s.subscribers[stream][ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers[stream], ch)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	initial, err := encodePut(doc)
+	if err != nil {
+		return
+	}
+	w.Write(initial)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(s.KeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case msg := <-ch:
+			w.Write(msg)
+		case <-keepAlive.C:
+			w.Write([]byte("event: keep-alive\ndata: null\n\n"))
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
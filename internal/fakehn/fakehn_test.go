@@ -0,0 +1,91 @@
+package fakehn
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+func TestServeREST(t *testing.T) {
+	fake := NewServer(Fixtures{
+		Items: map[model.ItemID]json.RawMessage{
+			8863: json.RawMessage(`{"id":8863,"type":"story","title":"My YC app"}`),
+		},
+		Users: map[model.UserID]json.RawMessage{
+			"dhouston": json.RawMessage(`{"id":"dhouston","karma":1}`),
+		},
+		Lists: map[model.ListName]model.StoryList{model.ListTop: {8863}},
+	})
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	cases := map[string]string{
+		"/item/8863.json":     `{"id":8863,"type":"story","title":"My YC app"}`,
+		"/item/1.json":        `null`,
+		"/user/dhouston.json": `{"id":"dhouston","karma":1}`,
+		"/maxitem.json":       `8863`,
+		"/topstories.json":    `[8863]`,
+		"/jobstories.json":    `[]`,
+		"/updates.json":       `{"items":null,"profiles":null}`,
+	}
+	for path, want := range cases {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		if got := strings.TrimSpace(string(body)); got != want {
+			t.Errorf("GET %s = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	fake := NewServer(Fixtures{MaxItem: 10})
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/maxitem.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading stream: %v", err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if got, want := readEvent(), "event: put\ndata: {\"path\":\"/\",\"data\":10}\n"; got != want {
+		t.Errorf("initial event = %q, want %q", got, want)
+	}
+	fake.SetItem(11, json.RawMessage(`{"id":11}`))
+	if got, want := readEvent(), "event: put\ndata: {\"path\":\"/\",\"data\":11}\n"; got != want {
+		t.Errorf("update event = %q, want %q", got, want)
+	}
+}
@@ -16,10 +16,12 @@ import (
 )
 
 var metrics = struct {
-	GetItemCacheHitLatency        prometheus.Histogram
-	GetItemCacheMissLatency       prometheus.Histogram
-	GetTopStoriesCacheHitLatency  prometheus.Histogram
-	GetTopStoriesCacheMissLatency prometheus.Histogram
+	GetItemCacheHitLatency  prometheus.Histogram
+	GetItemCacheMissLatency prometheus.Histogram
+	GetListCacheHitLatency  prometheus.Histogram
+	GetListCacheMissLatency prometheus.Histogram
+	GetUserCacheHitLatency  prometheus.Histogram
+	GetUserCacheMissLatency prometheus.Histogram
 }{
 	GetItemCacheHitLatency: promauto.NewHistogram(prometheus.HistogramOpts{
 		Name: "fasthacker_get_item_cache_hit_latency_seconds",
@@ -29,52 +31,71 @@ var metrics = struct {
 		Name: "fasthacker_get_item_cache_miss_latency_seconds",
 		Help: "The latency of cache misses for GetItem",
 	}),
-	GetTopStoriesCacheHitLatency: promauto.NewHistogram(prometheus.HistogramOpts{
-		Name: "fasthacker_get_top_stories_cache_hit_latency_seconds",
-		Help: "The latency of cache hits for GetTopStories",
+	GetListCacheHitLatency: promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "fasthacker_get_list_cache_hit_latency_seconds",
+		Help: "The latency of cache hits for GetList",
 	}),
-	GetTopStoriesCacheMissLatency: promauto.NewHistogram(prometheus.HistogramOpts{
-		Name: "fasthacker_get_top_stories_cache_miss_latency_seconds",
-		Help: "The latency of cache misses for GetTopStories",
+	GetListCacheMissLatency: promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "fasthacker_get_list_cache_miss_latency_seconds",
+		Help: "The latency of cache misses for GetList",
+	}),
+	GetUserCacheHitLatency: promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "fasthacker_get_user_cache_hit_latency_seconds",
+		Help: "The latency of cache hits for GetUser",
+	}),
+	GetUserCacheMissLatency: promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "fasthacker_get_user_cache_miss_latency_seconds",
+		Help: "The latency of cache misses for GetUser",
 	}),
 }
 
 type DataLoader interface {
-	GetTopStories() (model.TopStories, error)
+	GetList(name model.ListName) (model.StoryList, error)
 	GetItem(id model.ItemID) (model.Item, error)
+	GetListAt(name model.ListName, at time.Time) (model.StoryList, error)
+	GetItemAt(id model.ItemID, at time.Time) (model.Item, error)
+	GetUser(id model.UserID) (model.User, error)
+	GetFailedFetches() ([]model.FailedFetch, error)
 }
 
 type FirebaseNewsDataLoader struct {
-	c http.Client
+	c       http.Client
+	baseURL string
+}
+
+func NewFirebaseNewsDataLoader(baseURL string) FirebaseNewsDataLoader {
+	return FirebaseNewsDataLoader{baseURL: baseURL}
 }
 
 type CachingDataLoader struct {
-	delegate        DataLoader
-	itemCache       *cache.Cache[model.ItemID, model.Item]
-	topStoriesCache *cache.Cache[struct{}, model.TopStories]
+	delegate  DataLoader
+	itemCache *cache.Cache[model.ItemID, model.Item]
+	listCache *cache.Cache[model.ListName, model.StoryList]
+	userCache *cache.Cache[model.UserID, model.User]
 }
 
 func NewLoader(ctx context.Context, es *eventstore.EventStore) DataLoader {
 	return CachingDataLoader{
-		delegate:        eventstoredataloader.NewEventStoreDataLoader(es),
-		itemCache:       cache.NewContext[model.ItemID, model.Item](ctx),
-		topStoriesCache: cache.NewContext[struct{}, model.TopStories](ctx),
+		delegate:  eventstoredataloader.NewEventStoreDataLoader(es),
+		itemCache: cache.NewContext[model.ItemID, model.Item](ctx),
+		listCache: cache.NewContext[model.ListName, model.StoryList](ctx),
+		userCache: cache.NewContext[model.UserID, model.User](ctx),
 	}
 }
 
-func (c CachingDataLoader) GetTopStories() (model.TopStories, error) {
+func (c CachingDataLoader) GetList(name model.ListName) (model.StoryList, error) {
 	start := time.Now()
-	topStories, ok := c.topStoriesCache.Get(struct{}{})
+	list, ok := c.listCache.Get(name)
 	if ok {
-		metrics.GetTopStoriesCacheHitLatency.Observe(time.Since(start).Seconds())
-		return topStories, nil
+		metrics.GetListCacheHitLatency.Observe(time.Since(start).Seconds())
+		return list, nil
 	}
-	topStories, err := c.delegate.GetTopStories()
+	list, err := c.delegate.GetList(name)
 	if err == nil {
-		c.topStoriesCache.Set(struct{}{}, topStories, cache.WithExpiration(1*time.Minute))
-		metrics.GetTopStoriesCacheMissLatency.Observe(time.Since(start).Seconds())
+		c.listCache.Set(name, list, cache.WithExpiration(1*time.Minute))
+		metrics.GetListCacheMissLatency.Observe(time.Since(start).Seconds())
 	}
-	return topStories, err
+	return list, err
 }
 
 func (c CachingDataLoader) GetItem(id model.ItemID) (model.Item, error) {
@@ -92,20 +113,50 @@ func (c CachingDataLoader) GetItem(id model.ItemID) (model.Item, error) {
 	return item, nil
 }
 
-func (fb FirebaseNewsDataLoader) GetTopStories() (model.TopStories, error) {
-	resp, err := fb.c.Get("https://hacker-news.firebaseio.com/v0/topstories.json")
+func (c CachingDataLoader) GetUser(id model.UserID) (model.User, error) {
+	start := time.Now()
+	user, ok := c.userCache.Get(id)
+	if ok {
+		metrics.GetUserCacheHitLatency.Observe(time.Since(start).Seconds())
+		return user, nil
+	}
+	user, err := c.delegate.GetUser(id)
+	if err == nil {
+		c.userCache.Set(id, user, cache.WithExpiration(1*time.Minute))
+		metrics.GetUserCacheMissLatency.Observe(time.Since(start).Seconds())
+	}
+	return user, err
+}
+
+// GetListAt is not cached; past lists are rarely asked for twice.
+func (c CachingDataLoader) GetListAt(name model.ListName, at time.Time) (model.StoryList, error) {
+	return c.delegate.GetListAt(name, at)
+}
+
+// GetItemAt is not cached; past items are rarely asked for twice.
+func (c CachingDataLoader) GetItemAt(id model.ItemID, at time.Time) (model.Item, error) {
+	return c.delegate.GetItemAt(id, at)
+}
+
+// GetFailedFetches is not cached so the list reflects retries right away.
+func (c CachingDataLoader) GetFailedFetches() ([]model.FailedFetch, error) {
+	return c.delegate.GetFailedFetches()
+}
+
+func (fb FirebaseNewsDataLoader) GetList(name model.ListName) (model.StoryList, error) {
+	resp, err := fb.c.Get(fmt.Sprintf("%s/%s.json", fb.baseURL, name))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	jsonDecoder := json.NewDecoder(resp.Body)
-	var topStories model.TopStories
-	err = jsonDecoder.Decode(&topStories)
-	return topStories, err
+	var list model.StoryList
+	err = jsonDecoder.Decode(&list)
+	return list, err
 }
 
 func (fb FirebaseNewsDataLoader) GetStory(id model.ItemID) (model.Item, error) {
-	resp, err := fb.c.Get(fmt.Sprintf("https://hacker-news.firebaseio.com/v0/item/%d.json", id))
+	resp, err := fb.c.Get(fmt.Sprintf("%s/item/%d.json", fb.baseURL, id))
 	if err != nil {
 		return model.Item{}, err
 	}
@@ -120,7 +171,7 @@ func (fb FirebaseNewsDataLoader) GetStory(id model.ItemID) (model.Item, error) {
 }
 
 func (fb FirebaseNewsDataLoader) GetComment(id model.ItemID) (model.Item, error) {
-	resp, err := fb.c.Get(fmt.Sprintf("https://hacker-news.firebaseio.com/v0/item/%d.json", id))
+	resp, err := fb.c.Get(fmt.Sprintf("%s/item/%d.json", fb.baseURL, id))
 	if err != nil {
 		return model.Item{}, err
 	}
@@ -133,3 +184,18 @@ func (fb FirebaseNewsDataLoader) GetComment(id model.ItemID) (model.Item, error)
 	}
 	return comment, nil
 }
+
+func (fb FirebaseNewsDataLoader) GetUser(id model.UserID) (model.User, error) {
+	resp, err := fb.c.Get(fmt.Sprintf("%s/user/%s.json", fb.baseURL, id))
+	if err != nil {
+		return model.User{}, err
+	}
+	defer resp.Body.Close()
+	jsonDecoder := json.NewDecoder(resp.Body)
+	var user model.User
+	err = jsonDecoder.Decode(&user)
+	if err != nil {
+		return model.User{}, err
+	}
+	return user, nil
+}
@@ -17,6 +17,12 @@ type User struct {
 	Submitted *[]ItemID `json:"submitted"`
 }
 
+// ItemIDRange is the inclusive range of item IDs [Lo, Hi].
+type ItemIDRange struct {
+	Lo ItemID
+	Hi ItemID
+}
+
 type Item struct {
 	ID          ItemID    `json:"id"`
 	Deleted     *bool     `json:"deleted"`
@@ -34,7 +40,21 @@ type Item struct {
 	Descendants *int      `json:"descendants"`
 }
 
-type TopStories []ItemID
+// ListName is the Firebase name of a ranked story list, e.g. "topstories".
+type ListName string
+
+const (
+	ListTop  ListName = "topstories"
+	ListNew  ListName = "newstories"
+	ListBest ListName = "beststories"
+	ListAsk  ListName = "askstories"
+	ListShow ListName = "showstories"
+	ListJob  ListName = "jobstories"
+)
+
+var StoryLists = []ListName{ListTop, ListNew, ListBest, ListAsk, ListShow, ListJob}
+
+type StoryList []ItemID
 
 type Time struct {
 	time.Time
@@ -61,6 +81,41 @@ func (s *Item) Site() (string, error) {
 	return parsedUrl.Hostname(), nil
 }
 
+// FailedFetch is an item that could not be fetched even after retrying.
+// Class is "network", "http", "decode", or "null" / "empty" for items that
+// never became visible.
+type FailedFetch struct {
+	ItemID        ItemID
+	Class         string
+	Attempts      int
+	LastError     string
+	FirstFailedAt time.Time
+	LastFailedAt  time.Time
+	NextRetryAt   time.Time
+}
+
+// TransitionKind names a change between two revisions of an item.
+type TransitionKind string
+
+const (
+	TransitionDeleted     TransitionKind = "deleted"
+	TransitionKilled      TransitionKind = "killed"
+	TransitionResurrected TransitionKind = "resurrected"
+	TransitionTitleEdited TransitionKind = "title_edited"
+	TransitionURLChanged  TransitionKind = "url_changed"
+)
+
+// Transition records an item changing between revisions. Before and After
+// hold the edited title or URL; for deletions and kills Before keeps the
+// title or text that was visible until then.
+type Transition struct {
+	ItemID ItemID
+	Kind   TransitionKind
+	At     time.Time
+	Before string
+	After  string
+}
+
 type DataUpdate[T comparable] struct {
 	RxTime time.Time
 	ID     T
@@ -69,4 +124,4 @@ type DataUpdate[T comparable] struct {
 
 type UserUpdate DataUpdate[UserID]
 type ItemUpdate DataUpdate[ItemID]
-type TopStoriesUpdate DataUpdate[struct{}]
+type ListUpdate DataUpdate[ListName]
@@ -0,0 +1,87 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	eventlog "github.com/dan-mcdonald/fasthacker/internal/event-log"
+)
+
+// Config is everything a Sync needs to know about where to read from and
+// write to, and how hard to go at it.
+type Config struct {
+	Backend eventlog.Backend `yaml:"backend"`
+	// DBPath is the SQLite file, the Postgres connection string or the
+	// segments directory.
+	DBPath  string `yaml:"db"`
+	BaseURL string `yaml:"base_url"`
+	// UserAgent and From are sent with every upstream request so the API
+	// operators know who to contact. From is omitted when empty.
+	UserAgent string `yaml:"user_agent"`
+	From      string `yaml:"from"`
+	Workers   int    `yaml:"workers"`
+	BatchSize int    `yaml:"batch_size"`
+	// Rate and Burst bound upstream requests to Rate per second on average
+	// and Burst at once.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// PollInterval switches from SSE subscriptions to REST polling when set.
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// DefaultBaseURL is the root of the public Hacker News Firebase API.
+const DefaultBaseURL = "https://hacker-news.firebaseio.com/v0"
+
+const (
+	defaultWorkers   = 400
+	defaultBatchSize = 100
+	defaultRate      = 50
+	defaultBurst     = 50
+)
+
+func DefaultConfig() Config {
+	return Config{
+		Backend:   eventlog.BackendSQLite,
+		DBPath:    "hacker.db",
+		BaseURL:   DefaultBaseURL,
+		UserAgent: "fasthacker",
+		Workers:   defaultWorkers,
+		BatchSize: defaultBatchSize,
+		Rate:      defaultRate,
+		Burst:     defaultBurst,
+	}
+}
+
+func (c Config) Validate() error {
+	var errs []error
+	if err := c.Backend.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.DBPath == "" && c.Backend != eventlog.BackendMemory {
+		errs = append(errs, errors.New("db must be set"))
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("base_url %q is not an absolute URL", c.BaseURL))
+	}
+	if c.UserAgent == "" {
+		errs = append(errs, errors.New("user_agent must be set"))
+	}
+	if c.Workers < 1 {
+		errs = append(errs, fmt.Errorf("workers must be positive, got %d", c.Workers))
+	}
+	if c.BatchSize < 1 {
+		errs = append(errs, fmt.Errorf("batch_size must be positive, got %d", c.BatchSize))
+	}
+	if c.Rate <= 0 {
+		errs = append(errs, fmt.Errorf("rate must be positive, got %v", c.Rate))
+	}
+	if c.Burst < 1 {
+		errs = append(errs, fmt.Errorf("burst must be positive, got %d", c.Burst))
+	}
+	if c.PollInterval < 0 {
+		errs = append(errs, fmt.Errorf("poll_interval must not be negative, got %v", c.PollInterval))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,91 @@
+package sync
+
+import (
+	"sort"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+// idSet is a set of item IDs stored as sorted, disjoint, non-adjacent
+// ranges, so memory grows with the number of gaps rather than the number
+// of IDs.
+type idSet struct {
+	ranges []model.ItemIDRange
+	count  int
+}
+
+// search returns the index of the first range whose Hi is >= id.
+func (s *idSet) search(id model.ItemID) int {
+	return sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i].Hi >= id
+	})
+}
+
+func (s *idSet) contains(id model.ItemID) bool {
+	i := s.search(id)
+	return i < len(s.ranges) && s.ranges[i].Lo <= id
+}
+
+func (s *idSet) add(id model.ItemID) {
+	s.addRange(id, id)
+}
+
+// addRange adds every ID in [lo, hi].
+func (s *idSet) addRange(lo, hi model.ItemID) {
+	if lo > hi {
+		return
+	}
+	// first range that overlaps or touches [lo, hi]
+	start := s.search(lo - 1)
+	end := start
+	merged := model.ItemIDRange{Lo: lo, Hi: hi}
+	for end < len(s.ranges) && s.ranges[end].Lo <= hi+1 {
+		merged.Lo = min(merged.Lo, s.ranges[end].Lo)
+		merged.Hi = max(merged.Hi, s.ranges[end].Hi)
+		s.count -= int(s.ranges[end].Hi - s.ranges[end].Lo + 1)
+		end++
+	}
+	s.count += int(merged.Hi - merged.Lo + 1)
+	s.ranges = append(s.ranges[:start], append([]model.ItemIDRange{merged}, s.ranges[end:]...)...)
+}
+
+func (s *idSet) remove(id model.ItemID) {
+	s.removeRange(id, id)
+}
+
+// removeRange removes every ID in [lo, hi].
+func (s *idSet) removeRange(lo, hi model.ItemID) {
+	if lo > hi {
+		return
+	}
+	start := s.search(lo)
+	end := start
+	var kept []model.ItemIDRange
+	for end < len(s.ranges) && s.ranges[end].Lo <= hi {
+		r := s.ranges[end]
+		s.count -= int(r.Hi - r.Lo + 1)
+		if r.Lo < lo {
+			kept = append(kept, model.ItemIDRange{Lo: r.Lo, Hi: lo - 1})
+		}
+		if r.Hi > hi {
+			kept = append(kept, model.ItemIDRange{Lo: hi + 1, Hi: r.Hi})
+		}
+		end++
+	}
+	for _, r := range kept {
+		s.count += int(r.Hi - r.Lo + 1)
+	}
+	s.ranges = append(s.ranges[:start], append(kept, s.ranges[end:]...)...)
+}
+
+// max returns the highest ID in the set.
+func (s *idSet) max() (model.ItemID, bool) {
+	if len(s.ranges) == 0 {
+		return 0, false
+	}
+	return s.ranges[len(s.ranges)-1].Hi, true
+}
+
+func (s *idSet) len() int {
+	return s.count
+}
@@ -0,0 +1,20 @@
+package sync
+
+import "fmt"
+
+func Example_idSet() {
+	var ids idSet
+
+	ids.addRange(1, 10)
+	ids.addRange(20, 30)
+	ids.remove(5)
+	ids.removeRange(25, 40)
+	ids.addRange(11, 19)
+
+	fmt.Println(ids.ranges, ids.len())
+	fmt.Println(ids.contains(5), ids.contains(24), ids.contains(25))
+
+	// Output:
+	// [{1 4} {6 24}] 23
+	// false true false
+}
@@ -0,0 +1,180 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	stdsync "sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var limiterMetrics = struct {
+	ConcurrencyLimit prometheus.Gauge
+	InFlight         prometheus.Gauge
+	RateLimit        prometheus.Gauge
+	Backoffs         *prometheus.CounterVec
+}{
+	ConcurrencyLimit: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fasthacker_fetch_concurrency_limit",
+		Help: "Current adaptive limit on concurrent upstream fetches",
+	}),
+	InFlight: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fasthacker_fetch_in_flight",
+		Help: "Number of upstream fetches in flight",
+	}),
+	RateLimit: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fasthacker_fetch_rate_limit",
+		Help: "Maximum upstream fetches per second",
+	}),
+	Backoffs: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fasthacker_fetch_backoffs",
+		Help: "Number of times the fetch concurrency limit was cut, by reason",
+	}, []string{"reason"}),
+}
+
+// httpStatusError is a non-200 response from upstream.
+type httpStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d", e.StatusCode)
+}
+
+func (e *httpStatusError) throttled() bool {
+	return e.StatusCode == 429 || e.StatusCode >= 500
+}
+
+type limiterConfig struct {
+	rate               float64 // fetches per second
+	burst              int
+	initialConcurrency float64
+	minConcurrency     float64
+	maxConcurrency     float64
+	// latencySpike is how many times the smoothed latency a single fetch
+	// may take before it counts as congestion.
+	latencySpike float64
+	// decreaseCooldown keeps one burst of failures from cutting the limit
+	// more than once.
+	decreaseCooldown time.Duration
+}
+
+var defaultLimiterConfig = limiterConfig{
+	rate:               defaultRate,
+	burst:              defaultBurst,
+	initialConcurrency: 8,
+	minConcurrency:     1,
+	maxConcurrency:     defaultWorkers,
+	latencySpike:       4,
+	decreaseCooldown:   2 * time.Second,
+}
+
+// adaptiveLimiter paces upstream fetches with a token bucket and bounds how
+// many run at once with an AIMD limit: each clean response raises the limit
+// by about one per window, while throttling responses and latency spikes
+// halve it. A Retry-After from upstream pauses all fetches.
+type adaptiveLimiter struct {
+	config       limiterConfig
+	tokens       *rate.Limiter
+	mu           stdsync.Mutex
+	limit        float64
+	inFlight     int
+	latencyEWMA  time.Duration
+	lastDecrease time.Time
+	pausedUntil  time.Time
+	// released is closed and replaced whenever a slot frees up or the
+	// limit changes, waking every waiting acquire.
+	released chan struct{}
+}
+
+func newAdaptiveLimiter(config limiterConfig) *adaptiveLimiter {
+	l := &adaptiveLimiter{
+		config:   config,
+		tokens:   rate.NewLimiter(rate.Limit(config.rate), config.burst),
+		limit:    config.initialConcurrency,
+		released: make(chan struct{}),
+	}
+	limiterMetrics.RateLimit.Set(config.rate)
+	limiterMetrics.ConcurrencyLimit.Set(l.limit)
+	return l
+}
+
+// acquire blocks until a fetch may start. Every successful acquire must be
+// paired with a release.
+func (l *adaptiveLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if pause := time.Until(l.pausedUntil); pause > 0 {
+			l.mu.Unlock()
+			select {
+			case <-time.After(pause):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if float64(l.inFlight) < l.limit {
+			l.inFlight++
+			limiterMetrics.InFlight.Set(float64(l.inFlight))
+			l.mu.Unlock()
+			break
+		}
+		released := l.released
+		l.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := l.tokens.Wait(ctx); err != nil {
+		l.release(0, err)
+		return err
+	}
+	return nil
+}
+
+// release records the outcome of a fetch and adjusts the limit.
+func (l *adaptiveLimiter) release(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	limiterMetrics.InFlight.Set(float64(l.inFlight))
+
+	var statusErr *httpStatusError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.throttled():
+		if statusErr.RetryAfter > 0 {
+			l.pausedUntil = time.Now().Add(statusErr.RetryAfter)
+		}
+		l.decrease(fmt.Sprintf("http_%d", statusErr.StatusCode))
+	case err == nil && latency > 0:
+		if l.latencyEWMA > 0 && float64(latency) > l.config.latencySpike*float64(l.latencyEWMA) {
+			l.decrease("latency")
+		} else {
+			l.limit = min(l.config.maxConcurrency, l.limit+1/l.limit)
+		}
+		if l.latencyEWMA == 0 {
+			l.latencyEWMA = latency
+		} else {
+			l.latencyEWMA = (7*l.latencyEWMA + latency) / 8
+		}
+	}
+	limiterMetrics.ConcurrencyLimit.Set(l.limit)
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+func (l *adaptiveLimiter) decrease(reason string) {
+	if time.Since(l.lastDecrease) < l.config.decreaseCooldown {
+		return
+	}
+	l.lastDecrease = time.Now()
+	l.limit = max(l.config.minConcurrency, l.limit/2)
+	limiterMetrics.Backoffs.WithLabelValues(reason).Inc()
+}
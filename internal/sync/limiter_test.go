@@ -0,0 +1,52 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(limiterConfig{
+		rate:               1000,
+		burst:              1000,
+		initialConcurrency: 4,
+		minConcurrency:     1,
+		maxConcurrency:     100,
+		latencySpike:       4,
+		decreaseCooldown:   time.Hour,
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+		l.release(10*time.Millisecond, nil)
+	}
+	if l.limit <= 4 {
+		t.Errorf("limit after successes = %v, want > 4", l.limit)
+	}
+
+	before := l.limit
+	if err := l.acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	l.release(10*time.Millisecond, &httpStatusError{StatusCode: 429, RetryAfter: time.Hour})
+	if l.limit != before/2 {
+		t.Errorf("limit after 429 = %v, want %v", l.limit, before/2)
+	}
+	// within the cooldown a second failure leaves the limit alone
+	l.inFlight++
+	l.release(10*time.Millisecond, &httpStatusError{StatusCode: 503})
+	if l.limit != before/2 {
+		t.Errorf("limit after second failure = %v, want %v", l.limit, before/2)
+	}
+
+	// Retry-After pauses new fetches
+	shortCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(shortCtx); err == nil {
+		t.Errorf("acquire during Retry-After pause succeeded")
+	}
+}
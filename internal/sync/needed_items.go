@@ -2,49 +2,144 @@ package sync
 
 import "github.com/dan-mcdonald/fasthacker/internal/model"
 
+// priority orders the classes of needed items. Lower values are fetched
+// first; within a class the highest item ID goes first.
+type priority int
+
+const (
+	// priorityHot is for items on the front page or named in live updates,
+	// and for the kids, parts and parents they reference.
+	priorityHot priority = iota
+	// priorityRecent is for IDs discovered by maxitem moving forward, within
+	// recentWindow of it.
+	priorityRecent
+	// priorityBackfill is for gaps below what was stored at startup, and for
+	// IDs that maxitem jumped past by more than recentWindow.
+	priorityBackfill
+	numPriorities
+)
+
+// recentWindow is how many IDs up to a new maxitem count as recent, about a
+// day of new items. Older IDs discovered the same way, as on a fresh install
+// or after a long outage, are history to backfill.
+const recentWindow = 15000
+
+func (p priority) String() string {
+	switch p {
+	case priorityHot:
+		return "hot"
+	case priorityRecent:
+		return "recent"
+	case priorityBackfill:
+		return "backfill"
+	}
+	return "unknown"
+}
+
 type neededItems struct {
-	needed         map[model.ItemID]struct{}
+	needed         [numPriorities]idSet
+	known          idSet
 	maxKnownItemID model.ItemID
 }
 
 func newNeededItems() *neededItems {
 	return &neededItems{
-		needed:         make(map[model.ItemID]struct{}),
 		maxKnownItemID: model.ItemID(0),
 	}
 }
 
-func (n *neededItems) add(itemID model.ItemID) {
-	n.needed[itemID] = struct{}{}
+// add marks an item as needed, promoting it if it is already needed at a
+// less urgent priority.
+func (n *neededItems) add(itemID model.ItemID, p priority) {
+	for more := priority(0); more <= p; more++ {
+		if n.needed[more].contains(itemID) {
+			return
+		}
+	}
+	for less := p + 1; less < numPriorities; less++ {
+		n.needed[less].remove(itemID)
+	}
+	n.needed[p].add(itemID)
+}
+
+// addFresh marks IDs above maxKnownItemID as needed. Nothing in that range
+// can be needed already, so no promotion is required.
+func (n *neededItems) addFresh(lo, hi model.ItemID, p priority) {
+	n.needed[p].addRange(lo, hi)
 }
 
 func (n *neededItems) remove(itemID model.ItemID) {
-	delete(n.needed, itemID)
+	n.removeRange(itemID, itemID)
+}
+
+func (n *neededItems) removeRange(lo, hi model.ItemID) {
+	for p := range n.needed {
+		n.needed[p].removeRange(lo, hi)
+	}
 }
 
 func (n *neededItems) next() model.ItemID {
-	for itemID := range n.needed {
-		return itemID
+	for p := range n.needed {
+		if itemID, ok := n.needed[p].max(); ok {
+			return itemID
+		}
 	}
 	panic("attempted next() when items needed empty")
 }
 
 func (n *neededItems) size() int {
-	return len(n.needed)
+	total := 0
+	for p := range n.needed {
+		total += n.needed[p].len()
+	}
+	return total
+}
+
+func (n *neededItems) sizeOf(p priority) int {
+	return n.needed[p].len()
 }
 
 func (n *neededItems) empty() bool {
 	return n.size() == 0
 }
 
+func (n *neededItems) isNeeded(itemID model.ItemID) bool {
+	for p := range n.needed {
+		if n.needed[p].contains(itemID) {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyStored records ranges of items already in the event log. Any gap
+// below them that was not known about before is history to backfill.
+func (n *neededItems) notifyStored(ranges []model.ItemIDRange) {
+	for _, r := range ranges {
+		if r.Hi > n.maxKnownItemID {
+			n.addFresh(n.maxKnownItemID+1, r.Lo-1, priorityBackfill)
+			n.maxKnownItemID = r.Hi
+		}
+		n.known.addRange(r.Lo, r.Hi)
+		n.removeRange(r.Lo, r.Hi)
+	}
+}
+
 func (n *neededItems) notifySeen(seen itemSighting) {
+	if seen.present {
+		n.notifyStored([]model.ItemIDRange{{Lo: seen.id, Hi: seen.id}})
+		return
+	}
 	if seen.id > n.maxKnownItemID {
-		for i := n.maxKnownItemID + 1; i <= seen.id; i++ {
-			n.add(i)
+		lo := n.maxKnownItemID + 1
+		if seen.id-lo >= recentWindow {
+			n.addFresh(lo, seen.id-recentWindow, priorityBackfill)
+			lo = seen.id - recentWindow + 1
 		}
+		n.addFresh(lo, seen.id-1, priorityRecent)
+		n.add(seen.id, seen.priority)
 		n.maxKnownItemID = seen.id
-	}
-	if seen.present {
-		n.remove(seen.id)
+	} else if seen.refresh || n.isNeeded(seen.id) || (seen.ifMissing && !n.known.contains(seen.id)) {
+		n.add(seen.id, seen.priority)
 	}
 }
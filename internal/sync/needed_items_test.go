@@ -1,15 +1,19 @@
 package sync
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
 
 func Example_neededItems() {
 	// Create a new neededItems
 	needed := newNeededItems()
 
-	needed.notifySeen(itemSighting{3, true})
-	needed.notifySeen(itemSighting{5, true})
-	needed.notifySeen(itemSighting{1, true})
-	needed.notifySeen(itemSighting{7, false})
+	needed.notifySeen(itemSighting{id: 3, present: true})
+	needed.notifySeen(itemSighting{id: 5, present: true})
+	needed.notifySeen(itemSighting{id: 1, present: true})
+	needed.notifySeen(itemSighting{id: 7, present: false})
 
 	fmt.Println(needed.size())
 	needed.remove(2)
@@ -22,3 +26,69 @@ func Example_neededItems() {
 	// 4
 	// 0
 }
+
+func Example_neededItemsPriority() {
+	needed := newNeededItems()
+
+	// Stored at startup, leaving 1-2 as history to backfill
+	needed.notifySeen(itemSighting{id: 3, present: true})
+	// maxitem moved forward
+	needed.notifySeen(itemSighting{id: 6, present: false, priority: priorityRecent})
+	// 2 shows up on the front page
+	needed.notifySeen(itemSighting{id: 2, present: false, priority: priorityHot})
+
+	for !needed.empty() {
+		itemID := needed.next()
+		fmt.Println(itemID)
+		needed.remove(itemID)
+	}
+
+	// Output:
+	// 2
+	// 6
+	// 5
+	// 4
+	// 1
+}
+
+func Example_neededItemsDiscovery() {
+	needed := newNeededItems()
+
+	needed.notifySeen(itemSighting{id: 2, present: true})
+	needed.notifySeen(itemSighting{id: 4, present: true})
+	// 4 was fetched and references its parent 2 and kids 1 and 3
+	for _, ref := range []model.ItemID{2, 1, 3} {
+		needed.notifySeen(itemSighting{id: ref, present: false, priority: priorityHot, ifMissing: true})
+	}
+	fmt.Println(needed.sizeOf(priorityHot), needed.sizeOf(priorityBackfill))
+	// 3 was handed out but never stored; a plain sighting ignores it and a
+	// discovery sighting brings it back
+	needed.remove(3)
+	needed.notifySeen(itemSighting{id: 3, present: false, priority: priorityHot})
+	fmt.Println(needed.sizeOf(priorityHot))
+	needed.notifySeen(itemSighting{id: 3, present: false, priority: priorityHot, ifMissing: true})
+	fmt.Println(needed.sizeOf(priorityHot))
+
+	// Output:
+	// 2 0
+	// 1
+	// 2
+}
+
+func Example_neededItemsFreshInstall() {
+	needed := newNeededItems()
+
+	// nothing stored yet, and the first maxitem is far above recentWindow
+	needed.notifyStored(nil)
+	needed.notifySeen(itemSighting{id: 3 * recentWindow, present: false, priority: priorityRecent})
+	fmt.Println(needed.sizeOf(priorityRecent) == recentWindow, needed.sizeOf(priorityBackfill) == 2*recentWindow)
+	// maxitem moving forward a little is all recent
+	needed.notifySeen(itemSighting{id: 3*recentWindow + 10, present: false, priority: priorityRecent})
+	fmt.Println(needed.sizeOf(priorityRecent) == recentWindow+10, needed.sizeOf(priorityBackfill) == 2*recentWindow)
+	fmt.Println(needed.next())
+
+	// Output:
+	// true true
+	// true true
+	// 45010
+}
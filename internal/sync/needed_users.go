@@ -0,0 +1,36 @@
+package sync
+
+import "github.com/dan-mcdonald/fasthacker/internal/model"
+
+type neededUsers struct {
+	needed map[model.UserID]struct{}
+}
+
+func newNeededUsers() *neededUsers {
+	return &neededUsers{
+		needed: make(map[model.UserID]struct{}),
+	}
+}
+
+func (n *neededUsers) add(userID model.UserID) {
+	n.needed[userID] = struct{}{}
+}
+
+func (n *neededUsers) remove(userID model.UserID) {
+	delete(n.needed, userID)
+}
+
+func (n *neededUsers) next() model.UserID {
+	for userID := range n.needed {
+		return userID
+	}
+	panic("attempted next() when users needed empty")
+}
+
+func (n *neededUsers) size() int {
+	return len(n.needed)
+}
+
+func (n *neededUsers) empty() bool {
+	return n.size() == 0
+}
@@ -0,0 +1,216 @@
+package sync
+
+// Stories are re-fetched on a schedule that decays with age and rank so
+// that score and descendants are captured as a time series, not only when
+// Firebase happens to name a story in updates.
+
+import (
+	"container/heap"
+	"context"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+type repollConfig struct {
+	frontPageSize int
+	frontPage     time.Duration // interval while on the front page
+	ranked        time.Duration // interval while further down topstories
+	young         time.Duration // interval for unranked stories until youngAge
+	youngAge      time.Duration
+}
+
+var defaultRepollConfig = repollConfig{
+	frontPageSize: 30,
+	frontPage:     time.Minute,
+	ranked:        10 * time.Minute,
+	young:         time.Hour,
+	youngAge:      24 * time.Hour,
+}
+
+const unranked = -1
+
+// interval returns how long to wait between fetches of a story, or false if
+// it should no longer be re-polled. A zero submitted time means the story
+// has not been fetched yet.
+func (c repollConfig) interval(submitted time.Time, rank int, now time.Time) (time.Duration, string, bool) {
+	switch {
+	case rank != unranked && rank < c.frontPageSize:
+		return c.frontPage, "front_page", true
+	case rank != unranked:
+		return c.ranked, "ranked", true
+	case !submitted.IsZero() && now.Sub(submitted) < c.youngAge:
+		return c.young, "young", true
+	}
+	return 0, "", false
+}
+
+// storyFetched is sent to the re-poll scheduler for every story fetched.
+type storyFetched struct {
+	id        model.ItemID
+	submitted time.Time
+	at        time.Time
+}
+
+type repollEntry struct {
+	id        model.ItemID
+	submitted time.Time
+	rank      int
+	last      time.Time // last fetched or queued
+	due       time.Time
+	schedule  string
+	index     int
+}
+
+// repollQueue is a min-heap of entries by due time.
+type repollQueue []*repollEntry
+
+func (q repollQueue) Len() int           { return len(q) }
+func (q repollQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q repollQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *repollQueue) Push(x any) {
+	entry := x.(*repollEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+func (q *repollQueue) Pop() any {
+	old := *q
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return entry
+}
+
+type repollSchedule struct {
+	config  repollConfig
+	entries map[model.ItemID]*repollEntry
+	queue   repollQueue
+}
+
+func newRepollSchedule(config repollConfig) *repollSchedule {
+	return &repollSchedule{
+		config:  config,
+		entries: make(map[model.ItemID]*repollEntry),
+	}
+}
+
+// reschedule sets an entry's next due time counting from its last poll, or
+// drops it once it no longer qualifies for re-polling.
+func (r *repollSchedule) reschedule(entry *repollEntry, now time.Time) {
+	interval, schedule, ok := r.config.interval(entry.submitted, entry.rank, now)
+	if !ok {
+		if entry.index >= 0 {
+			heap.Remove(&r.queue, entry.index)
+		}
+		delete(r.entries, entry.id)
+		return
+	}
+	entry.due = entry.last.Add(interval)
+	entry.schedule = schedule
+	if entry.index >= 0 {
+		heap.Fix(&r.queue, entry.index)
+	} else {
+		r.entries[entry.id] = entry
+		heap.Push(&r.queue, entry)
+	}
+}
+
+func (r *repollSchedule) fetched(f storyFetched) {
+	entry, ok := r.entries[f.id]
+	if !ok {
+		entry = &repollEntry{id: f.id, rank: unranked, index: -1}
+	}
+	entry.submitted = f.submitted
+	entry.last = f.at
+	r.reschedule(entry, f.at)
+}
+
+// ranked applies a new topstories ranking. Polls are rescheduled from the
+// last one, so a story that moves onto the front page is due at once.
+func (r *repollSchedule) ranked(list model.StoryList, now time.Time) {
+	ranks := make(map[model.ItemID]int, len(list))
+	for rank, id := range list {
+		ranks[id] = rank
+	}
+	for id, entry := range r.entries {
+		if _, ok := ranks[id]; !ok && entry.rank != unranked {
+			entry.rank = unranked
+			r.reschedule(entry, now)
+		}
+	}
+	for id, rank := range ranks {
+		entry, ok := r.entries[id]
+		if !ok {
+			entry = &repollEntry{id: id, last: now, index: -1}
+		} else if entry.rank == rank {
+			continue
+		}
+		entry.rank = rank
+		r.reschedule(entry, now)
+	}
+}
+
+// due pops the entries due at now and schedules their next poll.
+func (r *repollSchedule) due(now time.Time) []*repollEntry {
+	var due []*repollEntry
+	for len(r.queue) > 0 && !r.queue[0].due.After(now) {
+		entry := r.queue[0]
+		due = append(due, entry)
+		entry.last = now
+		r.reschedule(entry, now)
+	}
+	return due
+}
+
+// next returns when the earliest entry is due, or false if none are
+// scheduled.
+func (r *repollSchedule) next() (time.Time, bool) {
+	if len(r.queue) == 0 {
+		return time.Time{}, false
+	}
+	return r.queue[0].due, true
+}
+
+func (s *Sync) repollManager(ctx context.Context) {
+	schedule := newRepollSchedule(defaultRepollConfig)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		timer.Stop()
+		if next, ok := schedule.next(); ok {
+			timer.Reset(time.Until(next))
+		}
+		s.metrics.StoriesRepollScheduled.Set(float64(len(schedule.entries)))
+		select {
+		case f := <-s.notifyStoryFetched:
+			schedule.fetched(f)
+		case list := <-s.notifyTopRanks:
+			schedule.ranked(list, time.Now())
+		case <-timer.C:
+			due := schedule.due(time.Now())
+			if len(due) == 0 {
+				continue
+			}
+			itemSightings := make([]itemSighting, 0, len(due))
+			for _, entry := range due {
+				p := priorityRecent
+				if entry.rank != unranked && entry.rank < defaultRepollConfig.frontPageSize {
+					p = priorityHot
+				}
+				itemSightings = append(itemSightings, itemSighting{id: entry.id, present: false, priority: p, refresh: true})
+				s.metrics.StoriesRepolled.WithLabelValues(entry.schedule).Inc()
+			}
+			select {
+			case s.itemSeen <- itemSightings:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
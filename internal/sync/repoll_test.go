@@ -0,0 +1,46 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+func TestRepollSchedule(t *testing.T) {
+	config := repollConfig{frontPageSize: 2, frontPage: time.Minute, ranked: 10 * time.Minute, young: time.Hour, youngAge: 24 * time.Hour}
+	r := newRepollSchedule(config)
+	t0 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	dueIDs := func(now time.Time) []model.ItemID {
+		var ids []model.ItemID
+		for _, entry := range r.due(now) {
+			ids = append(ids, entry.id)
+		}
+		return ids
+	}
+
+	r.fetched(storyFetched{id: 1, submitted: t0.Add(-time.Hour), at: t0})
+	r.fetched(storyFetched{id: 2, submitted: t0.Add(-48 * time.Hour), at: t0})
+	if _, ok := r.entries[2]; ok {
+		t.Errorf("unranked old story 2 scheduled")
+	}
+	if next, _ := r.next(); !next.Equal(t0.Add(time.Hour)) {
+		t.Errorf("young story due at %v, want %v", next, t0.Add(time.Hour))
+	}
+
+	r.ranked(model.StoryList{3, 1}, t0.Add(5*time.Minute))
+	if got := dueIDs(t0.Add(5 * time.Minute)); len(got) != 1 || got[0] != 1 {
+		t.Errorf("due after reaching front page = %v, want [1]", got)
+	}
+	if got := dueIDs(t0.Add(6 * time.Minute)); len(got) != 2 {
+		t.Errorf("due a minute later = %v, want [1 3]", got)
+	}
+
+	r.ranked(model.StoryList{3}, t0.Add(7*time.Minute))
+	if next, _ := r.next(); !next.Equal(t0.Add(7 * time.Minute)) {
+		t.Errorf("front page story due at %v, want %v", next, t0.Add(7*time.Minute))
+	}
+	if entry := r.entries[1]; entry.schedule != "young" || !entry.due.Equal(t0.Add(6*time.Minute+time.Hour)) {
+		t.Errorf("story 1 after leaving the list: %s due %v", entry.schedule, entry.due)
+	}
+}
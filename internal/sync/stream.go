@@ -0,0 +1,235 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	sse "github.com/r3labs/sse/v2"
+	"gopkg.in/cenkalti/backoff.v1"
+)
+
+var streamMetrics = struct {
+	Connects    *prometheus.CounterVec
+	Disconnects *prometheus.CounterVec
+	Stalls      *prometheus.CounterVec
+	Mode        *prometheus.GaugeVec
+	PollLatency *prometheus.HistogramVec
+}{
+	Connects: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fasthacker_sse_connects",
+		Help: "Number of SSE connections established, by stream",
+	}, []string{"stream"}),
+	Disconnects: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fasthacker_sse_disconnects",
+		Help: "Number of SSE connections lost, by stream",
+	}, []string{"stream"}),
+	Stalls: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fasthacker_sse_stalls",
+		Help: "Number of SSE connections dropped for going quiet, by stream",
+	}, []string{"stream"}),
+	Mode: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fasthacker_sync_mode",
+		Help: "1 for the active way of following upstream changes, sse or poll",
+	}, []string{"mode"}),
+	PollLatency: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fasthacker_poll_latency_seconds",
+		Help:    "Latency of polling a stream document over REST",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"stream"}),
+}
+
+// setSyncMode records which way upstream changes are followed.
+func setSyncMode(polling bool) {
+	if polling {
+		streamMetrics.Mode.WithLabelValues("sse").Set(0)
+		streamMetrics.Mode.WithLabelValues("poll").Set(1)
+	} else {
+		streamMetrics.Mode.WithLabelValues("poll").Set(0)
+		streamMetrics.Mode.WithLabelValues("sse").Set(1)
+	}
+}
+
+type streamConfig struct {
+	// stallTimeout is how long a stream may go without any event, keep-alives
+	// included, before the connection is dropped. Firebase sends a keep-alive
+	// every 30 seconds.
+	stallTimeout time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+}
+
+var defaultStreamConfig = streamConfig{
+	stallTimeout: 90 * time.Second,
+	minBackoff:   time.Second,
+	maxBackoff:   time.Minute,
+}
+
+// reconnectBackoff is the jittered delay before reconnect attempt n,
+// counting from 0: a random duration in [d/2, d) where d doubles from
+// minBackoff up to maxBackoff.
+func (c streamConfig) reconnectBackoff(n int) time.Duration {
+	d := c.minBackoff
+	for i := 0; i < n && d < c.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, c.maxBackoff)
+	return d/2 + rand.N(d/2+1)
+}
+
+// superviseStream keeps the SSE subscription to a stream open until ctx is
+// done, reconnecting with jittered backoff when the connection fails or
+// stalls. After every reconnect of the maxitem stream it polls maxitem over
+// REST so that items created while disconnected are still discovered; the
+// other streams reconnect with it, so one blip costs one catch-up.
+func (s *Sync) superviseStream(ctx context.Context, stream string, handle func(*sse.Event)) {
+	failures := 0
+	everConnected := false
+	for ctx.Err() == nil {
+		connected, err := s.subscribeOnce(ctx, stream, handle, everConnected)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			everConnected = true
+			failures = 0
+			streamMetrics.Disconnects.WithLabelValues(stream).Inc()
+			fmt.Printf("sync: SSE %s disconnected: %v\n", stream, err)
+		} else {
+			fmt.Printf("sync: SSE %s connect failed: %v\n", stream, err)
+		}
+		wait := s.streams.reconnectBackoff(failures)
+		failures++
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// subscribeOnce runs a single SSE connection until it fails, stalls or ctx
+// is done. It reports whether any event was received.
+func (s *Sync) subscribeOnce(ctx context.Context, stream string, handle func(*sse.Event), reconnect bool) (bool, error) {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The client's own reconnect loop is disabled; a fresh client per
+	// connection also keeps its connected state from leaking across attempts.
+	client := sse.NewClient(fmt.Sprintf("%s/%s.json", s.config.BaseURL, stream))
+	client.ReconnectStrategy = &backoff.StopBackOff{}
+	for k, v := range s.headers {
+		client.Headers[k] = v
+	}
+
+	var lastEvent atomic.Int64
+	lastEvent.Store(time.Now().UnixNano())
+	stalled := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.streams.stallTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if time.Since(time.Unix(0, lastEvent.Load())) < s.streams.stallTimeout {
+					continue
+				}
+				streamMetrics.Stalls.WithLabelValues(stream).Inc()
+				fmt.Printf("sync: SSE %s stalled\n", stream)
+				close(stalled)
+				cancel()
+				return
+			case <-connCtx.Done():
+				return
+			}
+		}
+	}()
+
+	connected := false
+	err := client.SubscribeWithContext(connCtx, "", func(msg *sse.Event) {
+		if !connected {
+			connected = true
+			streamMetrics.Connects.WithLabelValues(stream).Inc()
+			fmt.Printf("sync: SSE %s connected\n", stream)
+			if reconnect && stream == "maxitem" {
+				go s.catchUpMaxItem(ctx)
+			}
+		}
+		lastEvent.Store(time.Now().UnixNano())
+		handle(msg)
+	})
+	select {
+	case <-stalled:
+		err = fmt.Errorf("no event in %v", s.streams.stallTimeout)
+	default:
+	}
+	return connected, err
+}
+
+// catchUpMaxItem reads maxitem over REST and queues everything up to it.
+func (s *Sync) catchUpMaxItem(ctx context.Context) {
+	data, _, err := s.fetch(ctx, s.config.BaseURL+"/maxitem.json")
+	if err != nil {
+		fmt.Printf("sync.catchUpMaxItem: error fetching maxitem: %v\n", err)
+		return
+	}
+	var maxItem model.ItemID
+	if err := json.Unmarshal(data, &maxItem); err != nil {
+		fmt.Printf("sync.catchUpMaxItem: error decoding maxitem: %v\n", err)
+		return
+	}
+	fmt.Printf("sync: caught up to maxitem %d\n", maxItem)
+	select {
+	case s.itemSeen <- []itemSighting{{id: maxItem, present: false, priority: priorityRecent}}:
+	case <-ctx.Done():
+	}
+}
+
+// pollStream fetches a stream's document over REST every interval and
+// hands it to the same handler as the SSE put events, but only when it has
+// changed since the last poll. Polls wait their turn with the limiter like
+// any other fetch, but only the request itself counts as poll latency.
+func (s *Sync) pollStream(ctx context.Context, stream string, handle func(*sse.Event)) {
+	ticker := time.NewTicker(s.config.PollInterval)
+	defer ticker.Stop()
+	var last []byte
+	for {
+		var data []byte
+		err := s.limiter.acquire(ctx)
+		if err == nil {
+			startTime := time.Now()
+			data, _, err = s.get(ctx, fmt.Sprintf("%s/%s.json", s.config.BaseURL, stream))
+			latency := time.Since(startTime)
+			s.limiter.release(latency, err)
+			streamMetrics.PollLatency.WithLabelValues(stream).Observe(latency.Seconds())
+		}
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			fmt.Printf("sync.pollStream: error polling %s: %v\n", stream, err)
+		case !bytes.Equal(data, last):
+			last = data
+			msg, err := json.Marshal(struct {
+				Path string          `json:"path"`
+				Data json.RawMessage `json:"data"`
+			}{Path: "/", Data: data})
+			if err != nil {
+				fmt.Printf("sync.pollStream: error encoding %s: %v\n", stream, err)
+				break
+			}
+			handle(&sse.Event{Event: []byte("put"), Data: msg})
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package sync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/fakehn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStreamReconnectsAfterStall(t *testing.T) {
+	fake := fakehn.NewServer(storyFixtures(3))
+	fake.KeepAlive = time.Hour
+	srv := httptest.NewServer(fake)
+	synk := NewSync(testConfig(filepath.Join(t.TempDir(), "hacker.db"), srv.URL))
+	synk.streams = streamConfig{stallTimeout: 200 * time.Millisecond, minBackoff: 10 * time.Millisecond, maxBackoff: 50 * time.Millisecond}
+	connects := streamMetrics.Connects.WithLabelValues("updates")
+	stalls := streamMetrics.Stalls.WithLabelValues("updates")
+	startConnects, startStalls := testutil.ToFloat64(connects), testutil.ToFloat64(stalls)
+	if err := synk.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := synk.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+		srv.CloseClientConnections()
+		srv.Close()
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for testutil.ToFloat64(connects)-startConnects < 2 || testutil.ToFloat64(stalls)-startStalls < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connects +%v, stalls +%v; want a stall followed by a reconnect",
+				testutil.ToFloat64(connects)-startConnects, testutil.ToFloat64(stalls)-startStalls)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReconnectCatchesUpOnce(t *testing.T) {
+	fake := fakehn.NewServer(storyFixtures(3))
+	fake.KeepAlive = time.Hour
+	var catchUps atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/maxitem.json" && r.Header.Get("Accept") != "text/event-stream" {
+			catchUps.Add(1)
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	synk := NewSync(testConfig(filepath.Join(t.TempDir(), "hacker.db"), srv.URL))
+	synk.streams = streamConfig{stallTimeout: 200 * time.Millisecond, minBackoff: 10 * time.Millisecond, maxBackoff: 50 * time.Millisecond}
+	connects := streamMetrics.Connects.WithLabelValues("maxitem")
+	startConnects := testutil.ToFloat64(connects)
+	if err := synk.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := synk.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+		srv.CloseClientConnections()
+		srv.Close()
+	}()
+
+	// every stream stalls and reconnects at about the same time
+	deadline := time.Now().Add(10 * time.Second)
+	for testutil.ToFloat64(connects)-startConnects < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("maxitem stream did not reconnect")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	got := catchUps.Load()
+	if reconnects := int64(testutil.ToFloat64(connects)-startConnects) - 1; got > reconnects {
+		t.Errorf("%d maxitem catch-ups for %d reconnects of the maxitem stream", got, reconnects)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	stdsync "sync"
 	"time"
 
 	"github.com/avast/retry-go/v4"
@@ -19,14 +22,24 @@ import (
 )
 
 type metrics struct {
-	ItemsSeen                 prometheus.Counter
-	ItemsGotten               prometheus.Counter
-	ItemsNeeded               prometheus.Gauge
-	ItemsGetLatency           prometheus.Histogram
-	ItemsGetSize              prometheus.Histogram
-	ItemsGetStatus            *prometheus.CounterVec
-	logWriteItemBatchLatency  prometheus.Histogram
-	logWriteTopStoriesLatency prometheus.Histogram
+	ItemsSeen                prometheus.Counter
+	ItemsGotten              prometheus.Counter
+	ItemsStored              prometheus.Gauge
+	ItemsNeeded              *prometheus.GaugeVec
+	ItemsGetLatency          prometheus.Histogram
+	ItemsGetSize             prometheus.Histogram
+	ItemsFailed              *prometheus.CounterVec
+	ItemsGetStatus           *prometheus.CounterVec
+	ItemTransitions          *prometheus.CounterVec
+	StoriesRepollScheduled   prometheus.Gauge
+	StoriesRepolled          *prometheus.CounterVec
+	UsersGotten              prometheus.Counter
+	UsersNeeded              prometheus.Gauge
+	UsersGetStatus           *prometheus.CounterVec
+	PayloadsRecompressed     prometheus.Counter
+	logWriteItemBatchLatency prometheus.Histogram
+	logWriteUserBatchLatency prometheus.Histogram
+	logWriteListLatency      *prometheus.HistogramVec
 }
 
 func newSyncMetrics() *metrics {
@@ -39,10 +52,14 @@ func newSyncMetrics() *metrics {
 			Name: "fasthacker_items_gotten",
 			Help: "Number of items gotten",
 		}),
-		ItemsNeeded: promauto.NewGauge(prometheus.GaugeOpts{
+		ItemsStored: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "fasthacker_items_stored",
+			Help: "Number of distinct items stored",
+		}),
+		ItemsNeeded: promauto.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "fasthacker_items_needed",
 			Help: "Number of items needed",
-		}),
+		}, []string{"priority"}),
 		ItemsGetLatency: promauto.NewHistogram(prometheus.HistogramOpts{
 			Name: "fasthacker_items_get_latency",
 			Help: "Latency of items gotten",
@@ -52,39 +69,97 @@ func newSyncMetrics() *metrics {
 			Help:    "Size of items gotten",
 			Buckets: prometheus.ExponentialBuckets(32, 2, 15),
 		}),
+		ItemsFailed: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "fasthacker_items_failed",
+			Help: "Number of item fetches dead-lettered after retries, by failure class",
+		}, []string{"class"}),
 		ItemsGetStatus: promauto.NewCounterVec(prometheus.CounterOpts{
 			Name: "fasthacker_items_get_status",
 			Help: "Status of items gotten",
 		}, []string{"status"}),
+		ItemTransitions: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "fasthacker_item_transitions",
+			Help: "Number of transitions found between item revisions, by kind",
+		}, []string{"kind"}),
+		StoriesRepollScheduled: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "fasthacker_stories_repoll_scheduled",
+			Help: "Number of stories on the re-poll schedule",
+		}),
+		StoriesRepolled: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "fasthacker_stories_repolled",
+			Help: "Number of story re-polls queued, by schedule",
+		}, []string{"schedule"}),
+		PayloadsRecompressed: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "fasthacker_payloads_recompressed",
+			Help: "Number of stored payloads compressed by the background job",
+		}),
+		UsersGotten: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "fasthacker_users_gotten",
+			Help: "Number of user profiles gotten",
+		}),
+		UsersNeeded: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "fasthacker_users_needed",
+			Help: "Number of user profiles needed",
+		}),
+		UsersGetStatus: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "fasthacker_users_get_status",
+			Help: "Status of user profiles gotten",
+		}, []string{"status"}),
 		logWriteItemBatchLatency: promauto.NewHistogram(prometheus.HistogramOpts{
 			Name:    "fasthacker_log_write_item_batch_latency",
 			Help:    "Latency of log item batch writes",
 			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
 		}),
-		logWriteTopStoriesLatency: promauto.NewHistogram(prometheus.HistogramOpts{
-			Name:    "fasthacker_log_write_topstories_latency",
-			Help:    "Latency of log topstories writes",
+		logWriteUserBatchLatency: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "fasthacker_log_write_user_batch_latency",
+			Help:    "Latency of log user batch writes",
 			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
 		}),
+		logWriteListLatency: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "fasthacker_log_write_list_latency",
+			Help:    "Latency of log story list writes",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"list"}),
 	}
 
 	return m
 }
 
+var syncMetrics = newSyncMetrics()
+
 type itemSighting struct {
-	id      model.ItemID
-	present bool
+	id        model.ItemID
+	present   bool     // the item is stored
+	priority  priority // how urgently to fetch the item if it is needed
+	refresh   bool     // fetch the item again even if it is stored
+	ifMissing bool     // fetch the item if it is not stored, even if it was not needed
 }
 
 type Sync struct {
-	dbPath               string
+	config               Config
+	headers              map[string]string // sent with every upstream request
+	httpClient           *http.Client
 	metrics              *metrics
+	limiter              *adaptiveLimiter
+	streams              streamConfig
 	itemSeen             chan []itemSighting
+	itemsStored          chan []model.ItemIDRange
 	neededItemsWorkQueue chan model.ItemID
 	notifyItem           chan model.ItemUpdate
-	notifyTopStories     chan model.TopStoriesUpdate
+	notifyFailure        chan fetchFailure
+	notifyStoryFetched   chan storyFetched
+	notifyTopRanks       chan model.StoryList
+	userSeen             chan []model.UserID
+	neededUsersWorkQueue chan model.UserID
+	notifyUser           chan model.UserUpdate
+	notifyList           chan model.ListUpdate
 	eventStore           *eventstore.EventStore
 	eventStoreObserver   []chan *eventstore.EventStore
+	cancel               context.CancelFunc
+	workers              stdsync.WaitGroup
+	notVisibleMu         stdsync.Mutex
+	notVisible           map[model.ItemID]int // null or empty responses per item
+	done                 chan struct{}
 }
 
 func (s *Sync) EventStore() chan *eventstore.EventStore {
@@ -104,37 +179,50 @@ func (s *Sync) notifyEventStore() {
 	s.eventStoreObserver = nil
 }
 
-func NewSync(dbPath string) *Sync {
-	return &Sync{
-		dbPath:  dbPath,
-		metrics: newSyncMetrics(),
+// NewSync builds a Sync from a validated config.
+func NewSync(config Config) *Sync {
+	limiterConfig := defaultLimiterConfig
+	limiterConfig.rate = config.Rate
+	limiterConfig.burst = config.Burst
+	limiterConfig.maxConcurrency = float64(config.Workers)
+	headers := map[string]string{"User-Agent": config.UserAgent}
+	if config.From != "" {
+		headers["From"] = config.From
 	}
-}
+	s := &Sync{
+		config:  config,
+		headers: headers,
+		httpClient: &http.Client{
+			Transport: &FasthackerTransport{Headers: headers},
+			Timeout:   30 * time.Second,
+		},
+		metrics: syncMetrics,
+		limiter: newAdaptiveLimiter(limiterConfig),
+		streams: defaultStreamConfig,
 
-type FasthackerTransport struct{}
+		notVisible: make(map[model.ItemID]int),
+	}
+	return s
+}
 
-var customHeaders = map[string]string{
-	"User-Agent": "fasthacker",
-	"From":       "daniel@mcd.onald.net",
+// FasthackerTransport identifies us to upstream on every request.
+type FasthackerTransport struct {
+	Headers map[string]string
 }
 
 func (t *FasthackerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	for k, v := range customHeaders {
+	req = req.Clone(req.Context())
+	for k, v := range t.Headers {
 		req.Header.Set(k, v)
 	}
 	return http.DefaultTransport.RoundTrip(req)
 }
 
-var httpClient = http.Client{
-	Transport: &FasthackerTransport{},
-	Timeout:   30 * time.Second,
-}
-
 type MaxitemPutData struct {
 	MaxItem model.ItemID `json:"data"`
 }
 
-func (s *Sync) handleMaxItemEvent(msg *sse.Event) {
+func (s *Sync) handleMaxItemEvent(ctx context.Context, msg *sse.Event) {
 	msgEvent := string(msg.Event[:])
 	switch msgEvent {
 	case "put":
@@ -144,7 +232,10 @@ func (s *Sync) handleMaxItemEvent(msg *sse.Event) {
 			fmt.Printf("sync.handleMessage: error decoding maxitem put data: %v", err)
 		}
 		fmt.Printf("sync: new maxitem value %d\n", maxitemPutData.MaxItem)
-		s.itemSeen <- []itemSighting{{id: maxitemPutData.MaxItem, present: false}}
+		select {
+		case s.itemSeen <- []itemSighting{{id: maxitemPutData.MaxItem, present: false, priority: priorityRecent}}:
+		case <-ctx.Done():
+		}
 	case "keep-alive":
 		break
 	default:
@@ -160,7 +251,7 @@ type UpdatePutMessage struct {
 	} `json:"data"`
 }
 
-func (s *Sync) handleUpdateEvent(msg *sse.Event) {
+func (s *Sync) handleUpdateEvent(ctx context.Context, msg *sse.Event) {
 	msgEvent := string(msg.Event[:])
 	switch msgEvent {
 	case "put":
@@ -170,12 +261,21 @@ func (s *Sync) handleUpdateEvent(msg *sse.Event) {
 			fmt.Printf("sync.handleUpdateEvent: error decoding update put data: %v", err)
 		}
 		fmt.Printf("sync: update got %d items and %d profiles\n", len(updatePutMsg.Data.ItemIDs), len(updatePutMsg.Data.UserIDs))
-		itemSightings := make([]itemSighting, len(updatePutMsg.Data.ItemIDs))
+		itemSightings := make([]itemSighting, 0, len(updatePutMsg.Data.ItemIDs))
 		for _, itemID := range updatePutMsg.Data.ItemIDs {
-			itemSightings = append(itemSightings, itemSighting{id: itemID, present: false})
+			itemSightings = append(itemSightings, itemSighting{id: itemID, present: false, priority: priorityHot, refresh: true})
+		}
+		select {
+		case s.itemSeen <- itemSightings:
+		case <-ctx.Done():
+			return
+		}
+		if len(updatePutMsg.Data.UserIDs) > 0 {
+			select {
+			case s.userSeen <- updatePutMsg.Data.UserIDs:
+			case <-ctx.Done():
+			}
 		}
-		s.itemSeen <- itemSightings
-		// TODO handle profiles
 	case "keep-alive":
 		break
 	default:
@@ -183,166 +283,309 @@ func (s *Sync) handleUpdateEvent(msg *sse.Event) {
 	}
 }
 
+var (
+	// errInvalidJSON is returned for response bodies that are not an item.
+	errInvalidJSON = errors.New("invalid JSON")
+	// errItemNull is returned for the literal null Firebase serves for IDs
+	// that exist but are not published yet.
+	errItemNull = errors.New("item is null")
+	// errItemEmpty is returned for an empty response body.
+	errItemEmpty = errors.New("empty response")
+	// errUserNull is returned for the literal null Firebase serves for
+	// users that do not exist.
+	errUserNull = errors.New("user is null")
+)
+
+// fetchFailure is an item fetch that failed even after retrying.
+type fetchFailure struct {
+	itemID model.ItemID
+	class  string
+	err    error
+	at     time.Time
+}
+
+// classifyFetchError names the kind of failure for the dead-letter table
+// and the get status metrics.
+func classifyFetchError(err error) string {
+	var statusErr *httpStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		return "http"
+	case errors.Is(err, errInvalidJSON):
+		return "decode"
+	case errors.Is(err, errItemNull):
+		return "null"
+	case errors.Is(err, errItemEmpty):
+		return "empty"
+	default:
+		return "network"
+	}
+}
+
+const (
+	// failedFetchRetryInterval is how often the dead-letter table is
+	// checked for entries due another attempt.
+	failedFetchRetryInterval = time.Minute
+	failedFetchRetryBatch    = 1000
+	failedFetchBaseBackoff   = time.Minute
+	failedFetchMaxBackoff    = 24 * time.Hour
+)
+
+const (
+	// recompressInterval is how often a batch of payloads stored before
+	// compression was added is compressed, between other event log writes.
+	recompressInterval = 10 * time.Second
+	recompressBatch    = 1000
+)
+
+// fetchAttempts and fetchRetryDelay are how often, and how soon, a fetch
+// is retried before the item counts as failed. The delay doubles with each
+// attempt.
+var (
+	fetchAttempts   uint = 10
+	fetchRetryDelay      = 100 * time.Millisecond
+)
+
+// failedFetchBackoff is how long to wait before retrying an item that has
+// failed attempts times.
+func failedFetchBackoff(attempts int) time.Duration {
+	backoff := failedFetchBaseBackoff
+	for i := 1; i < attempts && backoff < failedFetchMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, failedFetchMaxBackoff)
+}
+
 type MinimalItem struct {
-	ID model.ItemID `json:"id"`
+	ID     model.ItemID   `json:"id"`
+	Type   string         `json:"type"`
+	Time   model.Time     `json:"time"`
+	Parent model.ItemID   `json:"parent"`
+	Kids   []model.ItemID `json:"kids"`
+	Parts  []model.ItemID `json:"parts"`
+}
+
+// references returns the IDs of the items this one links to in its thread.
+func (m MinimalItem) references() []model.ItemID {
+	refs := make([]model.ItemID, 0, len(m.Kids)+len(m.Parts)+1)
+	if m.Parent != 0 {
+		refs = append(refs, m.Parent)
+	}
+	refs = append(refs, m.Kids...)
+	return append(refs, m.Parts...)
+}
+
+func (m MinimalItem) isStory() bool {
+	return m.Type == "story" || m.Type == "poll" || m.Type == "job"
+}
+
+// checkItemBody rejects response bodies that are not the published item
+// we asked for.
+func checkItemBody(itemID model.ItemID, data []byte) (MinimalItem, error) {
+	var minimal MinimalItem
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return minimal, errItemEmpty
+	}
+	if bytes.Equal(trimmed, []byte("null")) {
+		return minimal, errItemNull
+	}
+	if err := json.Unmarshal(trimmed, &minimal); err != nil {
+		return minimal, fmt.Errorf("item %d: %w: %v", itemID, errInvalidJSON, err)
+	}
+	if minimal.ID != itemID {
+		return minimal, fmt.Errorf("item %d: %w: body has id %d", itemID, errInvalidJSON, minimal.ID)
+	}
+	return minimal, nil
+}
+
+// checkUserBody rejects response bodies that are not the profile we asked
+// for.
+func checkUserBody(userID model.UserID, data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return errItemEmpty
+	}
+	if bytes.Equal(trimmed, []byte("null")) {
+		return errUserNull
+	}
+	var user model.User
+	if err := json.Unmarshal(trimmed, &user); err != nil {
+		return fmt.Errorf("user %s: %w: %v", userID, errInvalidJSON, err)
+	}
+	if user.ID != userID {
+		return fmt.Errorf("user %s: %w: body has id %q", userID, errInvalidJSON, user.ID)
+	}
+	return nil
+}
+
+func notVisible(err error) bool {
+	return errors.Is(err, errItemNull) || errors.Is(err, errItemEmpty)
 }
 
-func requestItem(itemID model.ItemID) (model.ItemUpdate, error) {
-	resp, err := httpClient.Get(fmt.Sprintf("https://hacker-news.firebaseio.com/v0/item/%d.json", itemID))
+// notVisibleBaseDelay is how long to wait before asking again for an item
+// that came back null or empty. It doubles with each attempt.
+var notVisibleBaseDelay = 10 * time.Second
+
+// notVisibleMaxAttempts is how many null or empty responses an item gets
+// before it goes to the dead-letter table.
+const notVisibleMaxAttempts = 5
+
+// fetch GETs url from upstream once the limiter allows it and returns the
+// body along with the time it was received.
+func (s *Sync) fetch(ctx context.Context, url string) ([]byte, time.Time, error) {
+	if err := s.limiter.acquire(ctx); err != nil {
+		return nil, time.Time{}, err
+	}
+	startTime := time.Now()
+	body, rxTime, err := s.get(ctx, url)
+	s.limiter.release(time.Since(startTime), err)
+	return body, rxTime, err
+}
+
+func (s *Sync) get(ctx context.Context, url string) ([]byte, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return model.ItemUpdate{}, err
+		return nil, time.Time{}, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, time.Time{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, &httpStatusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
 	buf := new(bytes.Buffer)
 	_, err = buf.ReadFrom(resp.Body)
 	rxTime := time.Now()
 	if err != nil {
-		log.Printf("sync.requestItem: warning error reading response body: %v\n", err)
+		log.Printf("sync.get: warning error reading response body: %v\n", err)
+		return nil, time.Time{}, err
+	}
+	return buf.Bytes(), rxTime, nil
+}
+
+// parseRetryAfter reads a Retry-After header given either as seconds or as
+// an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func (s *Sync) requestItem(ctx context.Context, itemID model.ItemID) (model.ItemUpdate, error) {
+	data, rxTime, err := s.fetch(ctx, fmt.Sprintf("%s/item/%d.json", s.config.BaseURL, itemID))
+	if err != nil {
 		return model.ItemUpdate{}, err
 	}
 	return model.ItemUpdate{
 		RxTime: rxTime,
 		ID:     itemID,
-		Data:   buf.Bytes(),
+		Data:   data,
 	}, nil
 }
 
-func requestUser(userID model.UserID) (model.UserUpdate, error) {
-	fmt.Printf("requesting user %s\n", userID)
-	resp, err := httpClient.Get(fmt.Sprintf("https://hacker-news.firebaseio.com/v0/user/%s.json", userID))
-	if err != nil {
-		return model.UserUpdate{}, err
-	}
-	defer resp.Body.Close()
-	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(resp.Body)
-	rxTime := time.Now()
+func (s *Sync) requestUser(ctx context.Context, userID model.UserID) (model.UserUpdate, error) {
+	data, rxTime, err := s.fetch(ctx, fmt.Sprintf("%s/user/%s.json", s.config.BaseURL, userID))
 	if err != nil {
 		return model.UserUpdate{}, err
 	}
 	return model.UserUpdate{
 		RxTime: rxTime,
 		ID:     userID,
-		Data:   buf.Bytes(),
+		Data:   data,
 	}, nil
 }
 
-func (s *Sync) maxItemNotifierStart() error {
-	client := sse.NewClient("https://hacker-news.firebaseio.com/v0/maxitem.json")
-	client.OnConnect(func(c *sse.Client) {
-		fmt.Println("sync: SSE maxitem connected")
-	})
-	client.OnDisconnect(func(c *sse.Client) {
-		fmt.Println("sync: SSE maxitem disconnected")
-	})
-	ch := make(chan *sse.Event)
-	go func() {
-		for {
-			select {
-			case msg := <-ch:
-				s.handleMaxItemEvent(msg)
-			case <-time.After(5 * time.Minute):
-				log.Fatalf("sync.maxItemNotifierStart: no message received in 5 minutes")
-			}
-		}
-	}()
-	client.SubscribeChan("", ch)
-	return nil
+type listPutMessage struct {
+	Path string          `json:"path"`
+	Data model.StoryList `json:"data"`
 }
 
-func (s *Sync) updateListenerInit() error {
-	client := sse.NewClient("https://hacker-news.firebaseio.com/v0/updates.json")
-	client.OnConnect(func(c *sse.Client) {
-		fmt.Println("sync: SSE updates connected")
-	})
-	client.OnDisconnect(func(c *sse.Client) {
-		fmt.Println("sync: SSE updates disconnected")
-	})
-	ch := make(chan *sse.Event)
-	go func() {
-		for {
-			select {
-			case msg := <-ch:
-				s.handleUpdateEvent(msg)
-			case <-time.After(5 * time.Minute):
-				log.Fatalf("sync.updateListenerInit: no message received in 5 minutes")
-			}
-		}
-	}()
-	client.SubscribeChan("", ch)
-	return nil
-}
-
-func (s *Sync) topStoriesListenerInit() error {
-	client := sse.NewClient("https://hacker-news.firebaseio.com/v0/topstories.json")
-	client.OnConnect(func(c *sse.Client) {
-		fmt.Println("sync: SSE topstories connected")
-	})
-	client.OnDisconnect(func(c *sse.Client) {
-		fmt.Println("sync: SSE topstories disconnected")
-	})
-	ch := make(chan *sse.Event)
-	go func() {
-		for {
-			select {
-			case msg := <-ch:
-				s.handleTopStoriesEvent(msg)
-			case <-time.After(5 * time.Minute):
-				log.Fatalf("sync.topStoriesListenerInit: no message received in 5 minutes")
-			}
-		}
-	}()
-	client.SubscribeChan("", ch)
-	return nil
-}
-
-type topStoriesPutMessage struct {
-	Path string           `json:"path"`
-	Data model.TopStories `json:"data"`
-}
-
-func (s *Sync) handleTopStoriesEvent(msg *sse.Event) {
+func (s *Sync) handleListEvent(ctx context.Context, name model.ListName, msg *sse.Event) {
 	rxTime := time.Now()
 	msgEvent := string(msg.Event[:])
 	switch msgEvent {
 	case "put":
 		jsonDecoder := json.NewDecoder(bytes.NewReader(msg.Data))
-		var topStoriesPutMsg topStoriesPutMessage
-		if err := jsonDecoder.Decode(&topStoriesPutMsg); err != nil {
-			fmt.Printf("sync.handleTopStoriesEvent: error decoding topstories put data: %v", err)
+		var listPutMsg listPutMessage
+		if err := jsonDecoder.Decode(&listPutMsg); err != nil {
+			fmt.Printf("sync.handleListEvent: error decoding %s put data: %v", name, err)
 		}
-		fmt.Printf("sync: got %d topstories\n", len(topStoriesPutMsg.Data))
+		fmt.Printf("sync: got %d %s\n", len(listPutMsg.Data), name)
 		var data bytes.Buffer
 		jsonEncoder := json.NewEncoder(&data)
-		if err := jsonEncoder.Encode(topStoriesPutMsg.Data); err != nil {
-			fmt.Printf("sync.handleTopStoriesEvent: error encoding topstories data: %v", err)
+		if err := jsonEncoder.Encode(listPutMsg.Data); err != nil {
+			fmt.Printf("sync.handleListEvent: error encoding %s data: %v", name, err)
+		}
+		if name == model.ListTop {
+			itemSightings := make([]itemSighting, 0, len(listPutMsg.Data))
+			for _, itemID := range listPutMsg.Data {
+				itemSightings = append(itemSightings, itemSighting{id: itemID, present: false, priority: priorityHot})
+			}
+			select {
+			case s.itemSeen <- itemSightings:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case s.notifyTopRanks <- listPutMsg.Data:
+			case <-ctx.Done():
+				return
+			}
 		}
-		s.notifyTopStories <- model.TopStoriesUpdate{
+		select {
+		case s.notifyList <- model.ListUpdate{
 			RxTime: rxTime,
+			ID:     name,
 			Data:   data.Bytes(),
+		}:
+		case <-ctx.Done():
 		}
 	case "keep-alive":
 		break
 	default:
-		fmt.Printf("sync: topstories unknown event: %s\n", msgEvent)
+		fmt.Printf("sync: %s unknown event: %s\n", name, msgEvent)
 	}
 }
 
-func (s *Sync) neededItemsQueueManager() {
+func (s *Sync) neededItemsQueueManager(ctx context.Context) {
 	neededItems := newNeededItems()
+	select {
+	case storedRanges := <-s.itemsStored:
+		neededItems.notifyStored(storedRanges)
+	case <-ctx.Done():
+		return
+	}
+	s.reportItemsNeeded(neededItems)
 
 	handleItemSeen := func(itemSightings []itemSighting) {
 		s.metrics.ItemsSeen.Inc()
 		for _, itemSighting := range itemSightings {
 			neededItems.notifySeen(itemSighting)
 		}
-		s.metrics.ItemsNeeded.Set(float64(neededItems.size()))
+		s.reportItemsNeeded(neededItems)
 	}
 
 	for {
 		if neededItems.empty() {
-			candidateMaxItem := <-s.itemSeen
-			handleItemSeen(candidateMaxItem)
+			select {
+			case candidateMaxItem := <-s.itemSeen:
+				handleItemSeen(candidateMaxItem)
+			case <-ctx.Done():
+				return
+			}
 		} else {
 			nextItem := neededItems.next()
 			select {
@@ -350,121 +593,564 @@ func (s *Sync) neededItemsQueueManager() {
 				handleItemSeen(candidateMaxItem)
 			case s.neededItemsWorkQueue <- nextItem:
 				neededItems.remove(nextItem)
-				s.metrics.ItemsNeeded.Set(float64(neededItems.size()))
+				s.reportItemsNeeded(neededItems)
+			case <-ctx.Done():
+				return
 			}
 		}
 	}
 }
 
-func (s *Sync) getterWorker() {
-	for itemID := range s.neededItemsWorkQueue {
-		timer := prometheus.NewTimer(s.metrics.ItemsGetLatency)
-		itemUpdate, err := retry.DoWithData(func() (model.ItemUpdate, error) {
-			return requestItem(itemID)
-		})
-		if err != nil {
-			s.metrics.ItemsGetStatus.WithLabelValues("error").Inc()
-			log.Fatalf("sync.getterWorker: error requesting item %d: %v\n", itemID, err)
+func (s *Sync) reportItemsNeeded(neededItems *neededItems) {
+	s.metrics.ItemsStored.Set(float64(neededItems.known.len()))
+	for p := priority(0); p < numPriorities; p++ {
+		s.metrics.ItemsNeeded.WithLabelValues(p.String()).Set(float64(neededItems.sizeOf(p)))
+	}
+}
+
+func (s *Sync) neededUsersQueueManager(ctx context.Context) {
+	neededUsers := newNeededUsers()
+
+	handleUserSeen := func(userIDs []model.UserID) {
+		for _, userID := range userIDs {
+			neededUsers.add(userID)
+		}
+		s.metrics.UsersNeeded.Set(float64(neededUsers.size()))
+	}
+
+	for {
+		if neededUsers.empty() {
+			select {
+			case userIDs := <-s.userSeen:
+				handleUserSeen(userIDs)
+			case <-ctx.Done():
+				return
+			}
+		} else {
+			nextUser := neededUsers.next()
+			select {
+			case userIDs := <-s.userSeen:
+				handleUserSeen(userIDs)
+			case s.neededUsersWorkQueue <- nextUser:
+				neededUsers.remove(nextUser)
+				s.metrics.UsersNeeded.Set(float64(neededUsers.size()))
+			case <-ctx.Done():
+				return
+			}
 		}
-		s.metrics.ItemsGetStatus.WithLabelValues("ok").Inc()
-		s.metrics.ItemsGotten.Inc()
-		s.metrics.ItemsGetSize.Observe(float64(len(itemUpdate.Data)))
-		timer.ObserveDuration()
-		s.notifyItem <- itemUpdate
 	}
 }
 
-const logBatchWriteSize = 100
+// getterWorker fetches needed items and users until ctx is cancelled. A
+// fetch already in flight is finished and handed to the event log manager
+// so it lands in the final flush.
+func (s *Sync) getterWorker(ctx context.Context) {
+	defer s.workers.Done()
+	for {
+		select {
+		case itemID := <-s.neededItemsWorkQueue:
+			s.getItem(ctx, itemID)
+		case userID := <-s.neededUsersWorkQueue:
+			s.getUser(ctx, userID)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Sync) getItem(ctx context.Context, itemID model.ItemID) {
+	timer := prometheus.NewTimer(s.metrics.ItemsGetLatency)
+	var minimal MinimalItem
+	itemUpdate, err := retry.DoWithData(func() (model.ItemUpdate, error) {
+		itemUpdate, err := s.requestItem(ctx, itemID)
+		if err == nil {
+			minimal, err = checkItemBody(itemID, itemUpdate.Data)
+		}
+		return itemUpdate, err
+	}, retry.Context(ctx), retry.Attempts(fetchAttempts), retry.Delay(fetchRetryDelay), retry.LastErrorOnly(true), retry.RetryIf(func(err error) bool {
+		return !notVisible(err)
+	}))
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		if notVisible(err) {
+			s.requeueNotVisible(ctx, itemID, err)
+			return
+		}
+		s.clearNotVisible(itemID)
+		class := classifyFetchError(err)
+		s.metrics.ItemsGetStatus.WithLabelValues(class + "_error").Inc()
+		log.Printf("sync.getterWorker: error requesting item %d: %v\n", itemID, err)
+		s.notifyFailure <- fetchFailure{itemID: itemID, class: class, err: err, at: time.Now()}
+		return
+	}
+	s.clearNotVisible(itemID)
+	s.metrics.ItemsGetStatus.WithLabelValues("ok").Inc()
+	s.metrics.ItemsGotten.Inc()
+	s.metrics.ItemsGetSize.Observe(float64(len(itemUpdate.Data)))
+	timer.ObserveDuration()
+	s.notifyItem <- itemUpdate
+	if refs := minimal.references(); len(refs) > 0 {
+		itemSightings := make([]itemSighting, len(refs))
+		for i, ref := range refs {
+			itemSightings[i] = itemSighting{id: ref, present: false, priority: priorityHot, ifMissing: true}
+		}
+		select {
+		case s.itemSeen <- itemSightings:
+		case <-ctx.Done():
+		}
+	}
+	if minimal.isStory() {
+		select {
+		case s.notifyStoryFetched <- storyFetched{id: itemID, submitted: minimal.Time.Time, at: itemUpdate.RxTime}:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// requeueNotVisible asks for an item again after a delay that doubles with
+// each null or empty response, until it runs out of attempts and is
+// dead-lettered.
+func (s *Sync) requeueNotVisible(ctx context.Context, itemID model.ItemID, err error) {
+	class := classifyFetchError(err)
+	s.metrics.ItemsGetStatus.WithLabelValues(class).Inc()
+	s.notVisibleMu.Lock()
+	attempts := s.notVisible[itemID] + 1
+	if attempts >= notVisibleMaxAttempts {
+		delete(s.notVisible, itemID)
+		s.notVisibleMu.Unlock()
+		s.notifyFailure <- fetchFailure{itemID: itemID, class: class, err: err, at: time.Now()}
+		return
+	}
+	s.notVisible[itemID] = attempts
+	s.notVisibleMu.Unlock()
+	time.AfterFunc(notVisibleBaseDelay<<(attempts-1), func() {
+		select {
+		case s.itemSeen <- []itemSighting{{id: itemID, present: false, priority: priorityRecent, refresh: true}}:
+		case <-ctx.Done():
+		}
+	})
+}
+
+func (s *Sync) clearNotVisible(itemID model.ItemID) {
+	s.notVisibleMu.Lock()
+	delete(s.notVisible, itemID)
+	s.notVisibleMu.Unlock()
+}
+
+func (s *Sync) getUser(ctx context.Context, userID model.UserID) {
+	userUpdate, err := retry.DoWithData(func() (model.UserUpdate, error) {
+		userUpdate, err := s.requestUser(ctx, userID)
+		if err == nil {
+			err = checkUserBody(userID, userUpdate.Data)
+		}
+		return userUpdate, err
+	}, retry.Context(ctx), retry.Attempts(fetchAttempts), retry.Delay(fetchRetryDelay), retry.LastErrorOnly(true), retry.RetryIf(func(err error) bool {
+		return !errors.Is(err, errUserNull)
+	}))
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		status := "error"
+		switch {
+		case errors.Is(err, errUserNull):
+			status = "null"
+		case errors.Is(err, errInvalidJSON), errors.Is(err, errItemEmpty):
+			status = "decode_error"
+		}
+		s.metrics.UsersGetStatus.WithLabelValues(status).Inc()
+		log.Printf("sync.getterWorker: error requesting user %s: %v\n", userID, err)
+		return
+	}
+	s.metrics.UsersGetStatus.WithLabelValues("ok").Inc()
+	s.metrics.UsersGotten.Inc()
+	s.notifyUser <- userUpdate
+}
+
+// logBatchMaxLatency bounds how long a fetched item or user can wait in a
+// partial batch before it is written.
+const logBatchMaxLatency = 5 * time.Second
 
 func (s *Sync) startEventLogManager(ctx context.Context) error {
-	eventLog, err := eventlog.NewEventLog(s.dbPath)
+	eventLog, err := eventlog.Open(s.config.Backend, s.config.DBPath)
 	if err != nil {
 		return err
 	}
-	allItemIDs := eventLog.ItemIDs()
-	itemSightings := make([]itemSighting, len(allItemIDs))
-	for _, itemID := range allItemIDs {
-		itemSightings = append(itemSightings, itemSighting{id: itemID, present: true})
+	storedRanges, err := eventLog.ItemIDRanges()
+	if err != nil {
+		return err
 	}
-	s.itemSeen <- itemSightings
-	fmt.Printf("sync: db initialized with %d items\n", len(allItemIDs))
+	s.itemsStored <- storedRanges
+	fmt.Printf("sync: db initialized with %d ranges of items\n", len(storedRanges))
 
 	s.eventStore = eventstore.NewEventStore()
 	s.notifyEventStore()
 
-	go func() {
-		defer eventLog.Close()
-		var batch []model.ItemUpdate
-		for {
+	go s.eventLogManager(ctx, eventLog)
+	return nil
+}
+
+// eventLogBatches holds fetched updates not yet written to the event log.
+// Reads consult it first so they never miss data we already have.
+type eventLogBatches struct {
+	items []model.ItemUpdate
+	users []model.UserUpdate
+}
+
+func (b *eventLogBatches) latestItem(id model.ItemID) (*model.Item, bool, error) {
+	return b.itemAt(id, time.Time{})
+}
+
+// itemAt finds the latest pending revision of an item received at or before
+// at, or at any time if at is zero. Pending revisions are newer than any
+// stored one, so when there is one it is the answer.
+func (b *eventLogBatches) itemAt(id model.ItemID, at time.Time) (*model.Item, bool, error) {
+	for i := len(b.items) - 1; i >= 0; i-- {
+		if b.items[i].ID == id && (at.IsZero() || !b.items[i].RxTime.After(at)) {
+			var item model.Item
+			if err := json.Unmarshal(b.items[i].Data, &item); err != nil {
+				return nil, true, err
+			}
+			return &item, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (b *eventLogBatches) latestUser(id model.UserID) (*model.User, bool, error) {
+	for i := len(b.users) - 1; i >= 0; i-- {
+		if b.users[i].ID == id {
+			var user model.User
+			if err := json.Unmarshal(b.users[i].Data, &user); err != nil {
+				return nil, true, err
+			}
+			return &user, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (s *Sync) eventLogManager(ctx context.Context, eventLog eventlog.EventLog) {
+	defer close(s.done)
+	defer eventLog.Close()
+	defer s.eventStore.Close()
+	var batches eventLogBatches
+	flushTicker := time.NewTicker(logBatchMaxLatency)
+	defer flushTicker.Stop()
+	retryTicker := time.NewTicker(failedFetchRetryInterval)
+	defer retryTicker.Stop()
+	recompressTicker := time.NewTicker(recompressInterval)
+	defer recompressTicker.Stop()
+	recompressor, _ := eventLog.(eventlog.Recompressor)
+	for {
+		select {
+		case itemUpdate := <-s.notifyItem:
 			select {
-			case itemUpdate := <-s.notifyItem:
-				s.itemSeen <- []itemSighting{{id: itemUpdate.ID, present: true}}
-				batch = append(batch, itemUpdate)
-				if len(batch) >= logBatchWriteSize {
-					timer := prometheus.NewTimer(s.metrics.logWriteItemBatchLatency)
-					err := eventLog.WriteItemBatch(batch)
-					if err != nil {
-						log.Fatalf("sync.Run: error writing item %d: %v\n", itemUpdate.Data, err)
-					}
-					timer.ObserveDuration()
-					batch = batch[:0]
-				}
-			case topStoriesUpdate := <-s.notifyTopStories:
-				timer := prometheus.NewTimer(s.metrics.logWriteTopStoriesLatency)
-				err := eventLog.WriteTopStories(topStoriesUpdate)
-				if err != nil {
-					log.Fatalf("sync.Run: error writing top stories: %v\n", err)
-				}
-				timer.ObserveDuration()
-			case getItemReq := <-s.eventStore.GetItemReq:
-				item, err := eventLog.GetLatestItem(getItemReq.ID)
-				getItemReq.Resp <- eventstore.GetItemResponse{Item: item, Err: err}
-			case getTopStoriesReq := <-s.eventStore.GetTopStoriesReq:
-				topStories, err := eventLog.GetTopStories()
-				getTopStoriesReq.Resp <- eventstore.GetTopStoriesResponse{TopStories: topStories, Err: err}
+			case s.itemSeen <- []itemSighting{{id: itemUpdate.ID, present: true}}:
 			case <-ctx.Done():
-				return
 			}
+			s.addItem(eventLog, &batches, itemUpdate)
+		case userUpdate := <-s.notifyUser:
+			s.addUser(eventLog, &batches, userUpdate)
+		case listUpdate := <-s.notifyList:
+			s.writeList(eventLog, listUpdate)
+		case failure := <-s.notifyFailure:
+			s.recordFailure(eventLog, failure)
+		case <-flushTicker.C:
+			s.flushItems(eventLog, &batches)
+			s.flushUsers(eventLog, &batches)
+		case <-retryTicker.C:
+			s.retryFailedFetches(ctx, eventLog)
+		case <-recompressTicker.C:
+			if recompressor != nil && s.recompress(recompressor) {
+				recompressTicker.Stop()
+				recompressor = nil
+			}
+		case getFailedFetchesReq := <-s.eventStore.GetFailedFetchesReq:
+			failures, err := eventLog.FailedFetches()
+			getFailedFetchesReq.Resp <- eventstore.GetFailedFetchesResponse{FailedFetches: failures, Err: err}
+		case getItemReq := <-s.eventStore.GetItemReq:
+			item, pending, err := batches.latestItem(getItemReq.ID)
+			if !pending {
+				item, err = eventLog.GetLatestItem(getItemReq.ID)
+			}
+			getItemReq.Resp <- eventstore.GetItemResponse{Item: item, Err: err}
+		case getItemAtReq := <-s.eventStore.GetItemAtReq:
+			item, pending, err := batches.itemAt(getItemAtReq.ID, getItemAtReq.At)
+			if !pending {
+				item, err = eventLog.GetItemAt(getItemAtReq.ID, getItemAtReq.At)
+			}
+			getItemAtReq.Resp <- eventstore.GetItemResponse{Item: item, Err: err}
+		case getUserReq := <-s.eventStore.GetUserReq:
+			user, pending, err := batches.latestUser(getUserReq.ID)
+			if !pending {
+				user, err = eventLog.GetLatestUser(getUserReq.ID)
+			}
+			getUserReq.Resp <- eventstore.GetUserResponse{User: user, Err: err}
+		case getTransitionsReq := <-s.eventStore.GetTransitionsReq:
+			transitions, err := eventLog.GetTransitions(getTransitionsReq.From, getTransitionsReq.To)
+			getTransitionsReq.Resp <- eventstore.GetTransitionsResponse{Transitions: transitions, Err: err}
+		case getListReq := <-s.eventStore.GetListReq:
+			list, err := eventLog.GetList(getListReq.Name)
+			getListReq.Resp <- eventstore.GetListResponse{List: list, Err: err}
+		case getListAtReq := <-s.eventStore.GetListAtReq:
+			list, err := eventLog.GetListAt(getListAtReq.Name, getListAtReq.At)
+			getListAtReq.Resp <- eventstore.GetListResponse{List: list, Err: err}
+		case <-ctx.Done():
+			s.drainEventLog(eventLog, &batches)
+			return
 		}
+	}
+}
+
+// drainEventLog collects whatever the workers still deliver after
+// cancellation and writes out the partial batches.
+func (s *Sync) drainEventLog(eventLog eventlog.EventLog, batches *eventLogBatches) {
+	workersDone := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(workersDone)
 	}()
-	return nil
+	for draining := true; draining; {
+		select {
+		case itemUpdate := <-s.notifyItem:
+			s.addItem(eventLog, batches, itemUpdate)
+		case userUpdate := <-s.notifyUser:
+			s.addUser(eventLog, batches, userUpdate)
+		case listUpdate := <-s.notifyList:
+			s.writeList(eventLog, listUpdate)
+		case failure := <-s.notifyFailure:
+			s.recordFailure(eventLog, failure)
+		case <-workersDone:
+			draining = false
+		}
+	}
+	// workers are gone, but their last sends may still be buffered
+	for {
+		select {
+		case itemUpdate := <-s.notifyItem:
+			s.addItem(eventLog, batches, itemUpdate)
+		case userUpdate := <-s.notifyUser:
+			s.addUser(eventLog, batches, userUpdate)
+		case failure := <-s.notifyFailure:
+			s.recordFailure(eventLog, failure)
+		default:
+			s.flushItems(eventLog, batches)
+			s.flushUsers(eventLog, batches)
+			fmt.Println("sync: event log flushed")
+			return
+		}
+	}
 }
 
-const worker_count = 400
+func (s *Sync) addItem(eventLog eventlog.EventLog, batches *eventLogBatches, itemUpdate model.ItemUpdate) {
+	batches.items = append(batches.items, itemUpdate)
+	if len(batches.items) >= s.config.BatchSize {
+		s.flushItems(eventLog, batches)
+	}
+}
 
-// Start runs the sync.
-func (s *Sync) Start(ctx context.Context) error {
-	s.itemSeen = make(chan []itemSighting, worker_count)
-	s.neededItemsWorkQueue = make(chan model.ItemID, worker_count)
-	go s.neededItemsQueueManager()
-	s.notifyItem = make(chan model.ItemUpdate, worker_count)
-	s.notifyTopStories = make(chan model.TopStoriesUpdate)
+func (s *Sync) flushItems(eventLog eventlog.EventLog, batches *eventLogBatches) {
+	if len(batches.items) == 0 {
+		return
+	}
+	transitions := s.itemTransitions(eventLog, batches.items)
+	timer := prometheus.NewTimer(s.metrics.logWriteItemBatchLatency)
+	err := eventLog.WriteItemBatch(batches.items, transitions)
+	if err != nil {
+		log.Fatalf("sync.Run: error writing item batch: %v\n", err)
+	}
+	timer.ObserveDuration()
+	batches.items = batches.items[:0]
+}
 
-	var err error
+// itemTransitions compares each update in a batch with the revision before
+// it, whether stored or earlier in the same batch.
+func (s *Sync) itemTransitions(eventLog eventlog.EventLog, updates []model.ItemUpdate) []model.Transition {
+	ids := make([]model.ItemID, len(updates))
+	for i, update := range updates {
+		ids[i] = update.ID
+	}
+	latest, err := eventLog.LatestItems(ids)
+	if err != nil {
+		log.Printf("sync.itemTransitions: error reading previous revisions: %v\n", err)
+		return nil
+	}
+	var transitions []model.Transition
+	for _, update := range updates {
+		var item model.Item
+		if err := json.Unmarshal(update.Data, &item); err != nil {
+			continue
+		}
+		if prev, ok := latest[update.ID]; ok {
+			for _, t := range diffItem(*prev, item, update.RxTime) {
+				s.metrics.ItemTransitions.WithLabelValues(string(t.Kind)).Inc()
+				transitions = append(transitions, t)
+			}
+		}
+		latest[update.ID] = &item
+	}
+	return transitions
+}
 
-	err = s.startEventLogManager(ctx)
+func (s *Sync) addUser(eventLog eventlog.EventLog, batches *eventLogBatches, userUpdate model.UserUpdate) {
+	batches.users = append(batches.users, userUpdate)
+	if len(batches.users) >= s.config.BatchSize {
+		s.flushUsers(eventLog, batches)
+	}
+}
+
+func (s *Sync) flushUsers(eventLog eventlog.EventLog, batches *eventLogBatches) {
+	if len(batches.users) == 0 {
+		return
+	}
+	timer := prometheus.NewTimer(s.metrics.logWriteUserBatchLatency)
+	err := eventLog.WriteUserBatch(batches.users)
 	if err != nil {
-		log.Fatalf("sync.Run: error starting event log manager: %v\n", err)
+		log.Fatalf("sync.Run: error writing user batch: %v\n", err)
 	}
+	timer.ObserveDuration()
+	batches.users = batches.users[:0]
+}
 
-	for i := 0; i < worker_count; i++ {
-		go s.getterWorker()
+// recordFailure adds a failed fetch to the dead-letter table, or bumps its
+// attempt count, and schedules the next retry.
+func (s *Sync) recordFailure(eventLog eventlog.EventLog, failure fetchFailure) {
+	entry, err := eventLog.GetFailedFetch(failure.itemID)
+	if err != nil {
+		log.Fatalf("sync.recordFailure: error reading failed fetch %d: %v\n", failure.itemID, err)
+	}
+	if entry == nil {
+		entry = &model.FailedFetch{ItemID: failure.itemID, FirstFailedAt: failure.at}
 	}
+	entry.Class = failure.class
+	entry.Attempts++
+	entry.LastError = failure.err.Error()
+	entry.LastFailedAt = failure.at
+	entry.NextRetryAt = failure.at.Add(failedFetchBackoff(entry.Attempts))
+	if err := eventLog.PutFailedFetch(*entry); err != nil {
+		log.Fatalf("sync.recordFailure: error writing failed fetch %d: %v\n", failure.itemID, err)
+	}
+	s.metrics.ItemsFailed.WithLabelValues(failure.class).Inc()
+}
 
-	err = s.updateListenerInit()
+// retryFailedFetches queues dead-lettered items that are due another try.
+// Their next retry is pushed out now so they are not queued twice while the
+// fetch is in flight.
+func (s *Sync) retryFailedFetches(ctx context.Context, eventLog eventlog.EventLog) {
+	now := time.Now()
+	due, err := eventLog.DueFailedFetches(now, failedFetchRetryBatch)
 	if err != nil {
-		return err
+		log.Printf("sync.retryFailedFetches: error reading failed fetches: %v\n", err)
+		return
 	}
+	if len(due) == 0 {
+		return
+	}
+	itemSightings := make([]itemSighting, 0, len(due))
+	for _, entry := range due {
+		entry.NextRetryAt = now.Add(failedFetchBackoff(entry.Attempts + 1))
+		if err := eventLog.PutFailedFetch(entry); err != nil {
+			log.Fatalf("sync.retryFailedFetches: error writing failed fetch %d: %v\n", entry.ItemID, err)
+		}
+		itemSightings = append(itemSightings, itemSighting{id: entry.ItemID, present: false, priority: priorityRecent, refresh: true})
+	}
+	fmt.Printf("sync: retrying %d failed fetches\n", len(itemSightings))
+	select {
+	case s.itemSeen <- itemSightings:
+	case <-ctx.Done():
+	}
+}
 
-	err = s.maxItemNotifierStart()
+// recompress compresses a batch of payloads stored before compression was
+// added, and reports whether the job is done and can stop.
+func (s *Sync) recompress(recompressor eventlog.Recompressor) bool {
+	n, done, err := recompressor.Recompress(recompressBatch)
 	if err != nil {
-		return err
+		log.Printf("sync.recompress: %v\n", err)
 	}
+	s.metrics.PayloadsRecompressed.Add(float64(n))
+	if done {
+		fmt.Printf("sync: recompression done\n")
+	}
+	return done
+}
 
-	err = s.topStoriesListenerInit()
+func (s *Sync) writeList(eventLog eventlog.EventLog, listUpdate model.ListUpdate) {
+	timer := prometheus.NewTimer(s.metrics.logWriteListLatency.WithLabelValues(string(listUpdate.ID)))
+	err := eventLog.WriteList(listUpdate)
 	if err != nil {
-		return err
+		log.Fatalf("sync.Run: error writing %s: %v\n", listUpdate.ID, err)
+	}
+	timer.ObserveDuration()
+}
+
+// Start runs the sync until ctx is cancelled or Shutdown is called.
+func (s *Sync) Start(ctx context.Context) error {
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	s.itemSeen = make(chan []itemSighting, s.config.Workers)
+	s.itemsStored = make(chan []model.ItemIDRange, 1)
+	s.neededItemsWorkQueue = make(chan model.ItemID, s.config.Workers)
+	go s.neededItemsQueueManager(ctx)
+	s.notifyItem = make(chan model.ItemUpdate, s.config.Workers)
+	s.notifyFailure = make(chan fetchFailure, s.config.Workers)
+	s.userSeen = make(chan []model.UserID, s.config.Workers)
+	s.neededUsersWorkQueue = make(chan model.UserID, s.config.Workers)
+	go s.neededUsersQueueManager(ctx)
+	s.notifyUser = make(chan model.UserUpdate, s.config.Workers)
+	s.notifyList = make(chan model.ListUpdate)
+	s.notifyStoryFetched = make(chan storyFetched, s.config.Workers)
+	s.notifyTopRanks = make(chan model.StoryList, 1)
+	go s.repollManager(ctx)
+
+	var err error
+
+	err = s.startEventLogManager(ctx)
+	if err != nil {
+		log.Fatalf("sync.Run: error starting event log manager: %v\n", err)
+	}
+
+	s.workers.Add(s.config.Workers)
+	for i := 0; i < s.config.Workers; i++ {
+		go s.getterWorker(ctx)
+	}
+
+	follow := s.superviseStream
+	if s.config.PollInterval > 0 {
+		follow = s.pollStream
+	}
+	setSyncMode(s.config.PollInterval > 0)
+	go follow(ctx, "updates", func(msg *sse.Event) {
+		s.handleUpdateEvent(ctx, msg)
+	})
+	go follow(ctx, "maxitem", func(msg *sse.Event) {
+		s.handleMaxItemEvent(ctx, msg)
+	})
+	for _, name := range model.StoryLists {
+		go follow(ctx, string(name), func(msg *sse.Event) {
+			s.handleListEvent(ctx, name, msg)
+		})
 	}
 
 	return nil
 }
+
+// Shutdown stops the listeners and workers, flushes the batches still
+// waiting to be written and closes the event log. It returns early with
+// ctx's error if that takes longer than ctx allows. It does nothing if the
+// sync was never started.
+func (s *Sync) Shutdown(ctx context.Context) error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.cancel()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
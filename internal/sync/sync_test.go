@@ -0,0 +1,506 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	eventlog "github.com/dan-mcdonald/fasthacker/internal/event-log"
+	eventstore "github.com/dan-mcdonald/fasthacker/internal/event-store"
+	"github.com/dan-mcdonald/fasthacker/internal/fakehn"
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	sse "github.com/r3labs/sse/v2"
+)
+
+func storyFixtures(n int) fakehn.Fixtures {
+	items := make(map[model.ItemID]json.RawMessage, n)
+	for i := 1; i <= n; i++ {
+		items[model.ItemID(i)] = json.RawMessage(fmt.Sprintf(`{"id":%d,"type":"story","by":"pg","time":1160418111,"title":"Story %d"}`, i, i))
+	}
+	return fakehn.Fixtures{
+		Items: items,
+		Lists: map[model.ListName]model.StoryList{
+			model.ListTop: {1, 2, 3},
+			model.ListAsk: {2},
+		},
+	}
+}
+
+func testConfig(dbPath, baseURL string) Config {
+	config := DefaultConfig()
+	config.DBPath = dbPath
+	config.BaseURL = baseURL
+	return config
+}
+
+// startSync runs a Sync against a fake HN serving fixtures. The Sync is shut
+// down when the test ends unless the test already did so.
+func startSync(t *testing.T, dbPath string, fixtures fakehn.Fixtures) (*Sync, *eventstore.EventStore) {
+	t.Helper()
+	return startSyncAgainst(t, testConfig(dbPath, ""), fakehn.NewServer(fixtures))
+}
+
+// startSyncAgainst is startSync for tests that change or watch the fake HN
+// as they go, or need more config than the database. The base URL is set
+// to the fake's.
+func startSyncAgainst(t *testing.T, config Config, hn http.Handler) (*Sync, *eventstore.EventStore) {
+	t.Helper()
+	srv := httptest.NewServer(hn)
+	config.BaseURL = srv.URL
+	synk := NewSync(config)
+	if err := synk.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := synk.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+		srv.CloseClientConnections()
+		srv.Close()
+	})
+	return synk, <-synk.EventStore()
+}
+
+func TestSyncAgainstFake(t *testing.T) {
+	// not a whole number of batches, so some reads are served while pending
+	const itemCount = defaultBatchSize + defaultBatchSize/2
+	_, es := startSync(t, filepath.Join(t.TempDir(), "hacker.db"), storyFixtures(itemCount))
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		stored := 0
+		for id := model.ItemID(1); id <= itemCount; id++ {
+			item, err := es.GetLatestItem(id)
+			if err != nil {
+				continue
+			}
+			if item.ID != id || *item.Title != fmt.Sprintf("Story %d", id) {
+				t.Fatalf("GetLatestItem(%d) = %+v", id, item)
+			}
+			stored++
+		}
+		if stored == itemCount {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d items stored before deadline", stored, itemCount)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestSyncStoryLists(t *testing.T) {
+	modes := map[string]time.Duration{
+		"sse":  0,
+		"poll": 50 * time.Millisecond,
+	}
+	for mode, pollInterval := range modes {
+		t.Run(mode, func(t *testing.T) {
+			config := testConfig(filepath.Join(t.TempDir(), "hacker.db"), "")
+			config.PollInterval = pollInterval
+			_, es := startSyncAgainst(t, config, fakehn.NewServer(storyFixtures(3)))
+
+			want := map[model.ListName]model.StoryList{
+				model.ListTop: {1, 2, 3},
+				model.ListAsk: {2},
+				model.ListJob: {},
+			}
+			deadline := time.Now().Add(10 * time.Second)
+			for name, wantList := range want {
+				for {
+					list, err := es.GetList(name)
+					if err == nil && fmt.Sprint(*list) == fmt.Sprint(wantList) {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("GetList(%s) = %v, %v; want %v", name, list, err, wantList)
+					}
+					time.Sleep(50 * time.Millisecond)
+				}
+			}
+			for id := model.ItemID(1); id <= 3; id++ {
+				for {
+					if _, err := es.GetLatestItem(id); err == nil {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("item %d was never stored", id)
+					}
+					time.Sleep(50 * time.Millisecond)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownFlushesPartialBatch(t *testing.T) {
+	const itemCount = defaultBatchSize + defaultBatchSize/2
+	dbPath := filepath.Join(t.TempDir(), "hacker.db")
+	gottenBefore := testutil.ToFloat64(syncMetrics.ItemsGotten)
+	synk, _ := startSync(t, dbPath, storyFixtures(itemCount))
+
+	deadline := time.Now().Add(30 * time.Second)
+	for testutil.ToFloat64(syncMetrics.ItemsGotten)-gottenBefore < itemCount {
+		if time.Now().After(deadline) {
+			t.Fatalf("items not fetched before deadline")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := synk.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	eventLog, err := eventlog.NewEventLog(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eventLog.Close()
+	ranges, err := eventLog.ItemIDRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []model.ItemIDRange{{Lo: 1, Hi: itemCount}}; fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("stored ranges = %v, want %v", ranges, want)
+	}
+}
+
+func TestFailedFetchBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		5:  16 * time.Minute,
+		20: 24 * time.Hour,
+	}
+	for attempts, want := range cases {
+		if got := failedFetchBackoff(attempts); got != want {
+			t.Errorf("failedFetchBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestCheckItemBody(t *testing.T) {
+	tests := []struct {
+		body string
+		want error
+	}{
+		{`{"id":7,"type":"story"}`, nil},
+		{"null\n", errItemNull},
+		{"  ", errItemEmpty},
+		{`{"id":8}`, errInvalidJSON},
+		{`{"id":`, errInvalidJSON},
+	}
+	for _, tt := range tests {
+		if _, err := checkItemBody(7, []byte(tt.body)); !errors.Is(err, tt.want) {
+			t.Errorf("checkItemBody(%q) = %v, want %v", tt.body, err, tt.want)
+		}
+	}
+}
+
+func TestSyncUserFromUpdates(t *testing.T) {
+	hn := fakehn.NewServer(storyFixtures(1))
+	hn.SetUser("pg", json.RawMessage(`{"id":"pg","created":1160418092,"karma":155111,"about":"Bug fixer."}`))
+	dbPath := filepath.Join(t.TempDir(), "hacker.db")
+	synk, es := startSyncAgainst(t, testConfig(dbPath, ""), hn)
+	hn.PublishUpdate(nil, []model.UserID{"pg"})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		user, err := es.GetLatestUser("pg")
+		if err == nil {
+			if user.ID != "pg" || user.Karma != 155111 || user.About == nil || *user.About != "Bug fixer." {
+				t.Fatalf("GetLatestUser(pg) = %+v", user)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("profile in the updates feed was never fetched: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := synk.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	eventLog, err := eventlog.NewEventLog(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eventLog.Close()
+	if user, err := eventLog.GetLatestUser("pg"); err != nil || user.Karma != 155111 {
+		t.Errorf("stored profile = %+v, %v", user, err)
+	}
+}
+
+func TestCheckUserBody(t *testing.T) {
+	tests := []struct {
+		body string
+		want error
+	}{
+		{`{"id":"pg","karma":155111}`, nil},
+		{"null\n", errUserNull},
+		{"", errItemEmpty},
+		{`{"id":"dang"}`, errInvalidJSON},
+		{`{"id":`, errInvalidJSON},
+	}
+	for _, tt := range tests {
+		if err := checkUserBody("pg", []byte(tt.body)); !errors.Is(err, tt.want) {
+			t.Errorf("checkUserBody(%q) = %v, want %v", tt.body, err, tt.want)
+		}
+	}
+}
+
+func TestListEventAfterShutdownDoesNotBlock(t *testing.T) {
+	synk := NewSync(DefaultConfig())
+	synk.itemSeen = make(chan []itemSighting)
+	synk.notifyTopRanks = make(chan model.StoryList)
+	synk.notifyList = make(chan model.ListUpdate)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, name := range []model.ListName{model.ListTop, model.ListAsk} {
+			synk.handleListEvent(ctx, name, &sse.Event{Event: []byte("put"), Data: []byte(`{"path":"/","data":[1,2]}`)})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleListEvent blocked with nobody reading and its context done")
+	}
+}
+
+func TestShutdownBeforeStart(t *testing.T) {
+	if err := NewSync(DefaultConfig()).Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+}
+
+func TestEventStoreClosedAfterShutdown(t *testing.T) {
+	synk, es := startSync(t, filepath.Join(t.TempDir(), "hacker.db"), storyFixtures(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := synk.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := es.GetLatestItem(1); !errors.Is(err, eventstore.ErrClosed) {
+		t.Errorf("GetLatestItem after Shutdown = %v, want ErrClosed", err)
+	}
+}
+
+// runEventLogManager runs only the event log manager of a Sync, over
+// eventLog, for tests that hand it updates directly.
+func runEventLogManager(t *testing.T, config Config, eventLog eventlog.EventLog) *Sync {
+	t.Helper()
+	synk := NewSync(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	synk.cancel = cancel
+	synk.done = make(chan struct{})
+	synk.itemSeen = make(chan []itemSighting, 16)
+	synk.notifyItem = make(chan model.ItemUpdate)
+	synk.notifyUser = make(chan model.UserUpdate)
+	synk.notifyList = make(chan model.ListUpdate)
+	synk.notifyFailure = make(chan fetchFailure)
+	synk.eventStore = eventstore.NewEventStore()
+	go synk.eventLogManager(ctx, eventLog)
+	t.Cleanup(func() {
+		if err := synk.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return synk
+}
+
+func TestReadServesPendingRevision(t *testing.T) {
+	eventLog := eventlog.NewMemoryLog()
+	stored := model.ItemUpdate{ID: 1, RxTime: time.Now(), Data: []byte(`{"id":1,"type":"story","title":"stored"}`)}
+	if err := eventLog.WriteItemBatch([]model.ItemUpdate{stored}, nil); err != nil {
+		t.Fatal(err)
+	}
+	synk := runEventLogManager(t, DefaultConfig(), eventLog)
+
+	synk.notifyItem <- model.ItemUpdate{ID: 1, RxTime: time.Now(), Data: []byte(`{"id":1,"type":"story","title":"pending"}`)}
+	item, err := synk.eventStore.GetLatestItem(1)
+	if err != nil || item.Title == nil || *item.Title != "pending" {
+		t.Errorf("GetLatestItem = %+v, %v; want the pending revision", item, err)
+	}
+	if item, err := eventLog.GetLatestItem(1); err != nil || *item.Title != "stored" {
+		t.Errorf("event log has %+v, %v; want the pending revision not yet written", item, err)
+	}
+}
+
+func TestFlushTickerWritesPartialBatch(t *testing.T) {
+	eventLog := eventlog.NewMemoryLog()
+	synk := runEventLogManager(t, DefaultConfig(), eventLog)
+
+	start := time.Now()
+	synk.notifyItem <- model.ItemUpdate{ID: 1, RxTime: start, Data: []byte(`{"id":1,"type":"story"}`)}
+	for {
+		if _, err := eventLog.GetLatestItem(1); err == nil {
+			break
+		}
+		if time.Since(start) > logBatchMaxLatency+time.Second {
+			t.Fatalf("partial batch not written within %v", logBatchMaxLatency)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestGetHonorsContext(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(hang)
+	synk := NewSync(testConfig("", srv.URL))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := synk.get(ctx, srv.URL+"/item/1.json"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("get = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("get returned after %v, not when its context ended", elapsed)
+	}
+}
+
+func TestFailedFetchIsDeadLetteredAndRetried(t *testing.T) {
+	attempts, delay := fetchAttempts, fetchRetryDelay
+	fetchAttempts, fetchRetryDelay = 2, time.Millisecond
+	defer func() { fetchAttempts, fetchRetryDelay = attempts, delay }()
+
+	hn := fakehn.NewServer(fakehn.Fixtures{Items: map[model.ItemID]json.RawMessage{
+		5: json.RawMessage(`{"id":6,"type":"comment"}`),
+	}})
+	srv := httptest.NewServer(hn)
+	defer srv.Close()
+	eventLog := eventlog.NewMemoryLog()
+	synk := runEventLogManager(t, testConfig("", srv.URL), eventLog)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	synk.getItem(ctx, 5)
+	failures, err := synk.eventStore.GetFailedFetches()
+	if err != nil || len(failures) != 1 {
+		t.Fatalf("GetFailedFetches = %v, %v; want one entry", failures, err)
+	}
+	entry := failures[0]
+	if entry.ItemID != 5 || entry.Class != "decode" || entry.Attempts != 1 || entry.NextRetryAt.Sub(entry.LastFailedAt) != failedFetchBaseBackoff {
+		t.Errorf("dead-letter entry = %+v", entry)
+	}
+
+	// the retry is not due yet
+	synk.retryFailedFetches(ctx, eventLog)
+	select {
+	case sightings := <-synk.itemSeen:
+		t.Fatalf("retried early: %+v", sightings)
+	default:
+	}
+
+	entry.NextRetryAt = time.Now().Add(-time.Second)
+	if err := eventLog.PutFailedFetch(entry); err != nil {
+		t.Fatal(err)
+	}
+	synk.retryFailedFetches(ctx, eventLog)
+	select {
+	case sightings := <-synk.itemSeen:
+		if len(sightings) != 1 || sightings[0].id != 5 || !sightings[0].refresh {
+			t.Errorf("retry queued %+v", sightings)
+		}
+	default:
+		t.Fatal("due entry was not queued for retry")
+	}
+	if entry, err := eventLog.GetFailedFetch(5); err != nil || !entry.NextRetryAt.After(time.Now()) {
+		t.Errorf("queued entry = %+v, %v; want its next retry pushed out", entry, err)
+	}
+
+	hn.SetItem(5, json.RawMessage(`{"id":5,"type":"comment","text":"fixed"}`))
+	synk.getItem(ctx, 5)
+	deadline := time.Now().Add(logBatchMaxLatency + time.Second)
+	for {
+		entry, err := eventLog.GetFailedFetch(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entry %+v not cleared once the item was written", entry)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestNullItemIsRequeuedThenDeadLettered(t *testing.T) {
+	delay := notVisibleBaseDelay
+	notVisibleBaseDelay = 100 * time.Millisecond
+	defer func() { notVisibleBaseDelay = delay }()
+
+	// item 3 exists according to maxitem but is served as null
+	fixtures := storyFixtures(2)
+	fixtures.MaxItem = 3
+	hn := fakehn.NewServer(fixtures)
+	var mu stdsync.Mutex
+	var asked []time.Time
+	watch := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/item/3.json" {
+			mu.Lock()
+			asked = append(asked, time.Now())
+			mu.Unlock()
+		}
+		hn.ServeHTTP(w, r)
+	})
+	_, es := startSyncAgainst(t, testConfig(filepath.Join(t.TempDir(), "hacker.db"), ""), watch)
+
+	deadline := time.Now().Add(30 * time.Second)
+	var failures []model.FailedFetch
+	for {
+		var err error
+		failures, err = es.GetFailedFetches()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(failures) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("null item was never dead-lettered")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(failures) != 1 || failures[0].ItemID != 3 || failures[0].Class != "null" || failures[0].Attempts != 1 {
+		t.Errorf("dead-letter entries = %+v, want item 3 failed as null", failures)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(asked) != notVisibleMaxAttempts {
+		t.Fatalf("item 3 fetched %d times, want %d", len(asked), notVisibleMaxAttempts)
+	}
+	for i := 1; i < len(asked); i++ {
+		if wait, want := asked[i].Sub(asked[i-1]), notVisibleBaseDelay<<(i-1); wait < want {
+			t.Errorf("fetch %d came %v after the one before, want at least %v", i+1, wait, want)
+		}
+	}
+}
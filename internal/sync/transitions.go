@@ -0,0 +1,51 @@
+package sync
+
+import (
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+func isSet(flag *bool) bool {
+	return flag != nil && *flag
+}
+
+func deref[T ~string](s *T) string {
+	if s == nil {
+		return ""
+	}
+	return string(*s)
+}
+
+// visibleText is what a reader saw of an item: its title, or its text if
+// it has none.
+func visibleText(item model.Item) string {
+	if item.Title != nil {
+		return *item.Title
+	}
+	return deref(item.Text)
+}
+
+// diffItem returns the transitions from revision prev to next, received at.
+func diffItem(prev, next model.Item, at time.Time) []model.Transition {
+	var transitions []model.Transition
+	add := func(kind model.TransitionKind, before, after string) {
+		transitions = append(transitions, model.Transition{ItemID: next.ID, Kind: kind, At: at, Before: before, After: after})
+	}
+	if !isSet(prev.Deleted) && isSet(next.Deleted) {
+		add(model.TransitionDeleted, visibleText(prev), "")
+	}
+	if !isSet(prev.Dead) && isSet(next.Dead) {
+		add(model.TransitionKilled, visibleText(prev), "")
+	}
+	if isSet(prev.Dead) && !isSet(next.Dead) && !isSet(next.Deleted) {
+		add(model.TransitionResurrected, "", visibleText(next))
+	}
+	if prev.Title != nil && next.Title != nil && *prev.Title != *next.Title {
+		add(model.TransitionTitleEdited, *prev.Title, *next.Title)
+	}
+	if prev.URL != nil && next.URL != nil && *prev.URL != *next.URL {
+		add(model.TransitionURLChanged, *prev.URL, *next.URL)
+	}
+	return transitions
+}
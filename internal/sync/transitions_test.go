@@ -0,0 +1,43 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+func TestDiffItem(t *testing.T) {
+	parse := func(data string) model.Item {
+		var item model.Item
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+	tests := []struct {
+		prev, next string
+		want       string
+	}{
+		{`{"id":1,"title":"A","url":"http://a"}`, `{"id":1,"title":"A","url":"http://a"}`, `[]`},
+		{`{"id":1,"title":"A"}`, `{"id":1,"deleted":true}`, `[{deleted A }]`},
+		{`{"id":1,"text":"hi"}`, `{"id":1,"text":"hi","dead":true}`, `[{killed hi }]`},
+		{`{"id":1,"title":"A","dead":true}`, `{"id":1,"title":"A"}`, `[{resurrected  A}]`},
+		{`{"id":1,"title":"A","url":"http://a"}`, `{"id":1,"title":"B","url":"http://b"}`, `[{title_edited A B} {url_changed http://a http://b}]`},
+	}
+	at := time.Unix(1700000000, 0)
+	for _, tt := range tests {
+		var got []string
+		for _, transition := range diffItem(parse(tt.prev), parse(tt.next), at) {
+			if transition.ItemID != 1 || !transition.At.Equal(at) {
+				t.Errorf("transition %+v has wrong item or time", transition)
+			}
+			got = append(got, fmt.Sprintf("{%s %s %s}", transition.Kind, transition.Before, transition.After))
+		}
+		if fmt.Sprint(got) != tt.want {
+			t.Errorf("diffItem(%s, %s) = %v, want %s", tt.prev, tt.next, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
@@ -9,6 +10,7 @@ import (
 	"net/url"
 	"time"
 
+	eventlog "github.com/dan-mcdonald/fasthacker/internal/event-log"
 	eventstore "github.com/dan-mcdonald/fasthacker/internal/event-store"
 	"github.com/dan-mcdonald/fasthacker/internal/loader"
 	"github.com/dan-mcdonald/fasthacker/internal/model"
@@ -18,16 +20,24 @@ type fastHacker struct {
 	staticHandler http.Handler
 	indexTmpl     *template.Template
 	itemTmpl      *template.Template
+	failedTmpl    *template.Template
 	dl            loader.DataLoader
 }
 
 func ago(t model.Time) string {
-	return time.Since(t.Time).Round(time.Second).String()
+	return timeAgo(t.Time)
 }
 
+func timeAgo(t time.Time) string {
+	return time.Since(t).Round(time.Second).String()
+}
+
+// StoryListPage and StoryPage carry the at query parameter, as formatted by
+// formatAt, so links keep showing the same moment.
 type StoryListPage struct {
 	RankOffset int
 	Stories    []model.Item
+	At         string
 }
 
 type TraversedComment struct {
@@ -38,13 +48,23 @@ type TraversedComment struct {
 type StoryPage struct {
 	Story       *model.Item
 	CommentTree []TraversedComment
+	At          string
 }
 
-func GetCommentTree(story model.Item, dl *loader.DataLoader) ([]TraversedComment, error) {
+// ItemGetter loads an item, either its latest revision or the one at a past
+// time.
+type ItemGetter func(id model.ItemID) (model.Item, error)
+
+// GetCommentTree walks the comments under story depth first. Comments that
+// have not been captured are left out.
+func GetCommentTree(story model.Item, get ItemGetter) ([]TraversedComment, error) {
 	var commentTraversal []TraversedComment
 	var traverse func(model.ItemID, int) error
 	traverse = func(commentId model.ItemID, level int) error {
-		comment, err := (*dl).GetItem(commentId)
+		comment, err := get(commentId)
+		if errors.Is(err, eventlog.ErrNotFound) {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -52,6 +72,9 @@ func GetCommentTree(story model.Item, dl *loader.DataLoader) ([]TraversedComment
 			Comment: comment,
 			Level:   level,
 		})
+		if comment.Kids == nil {
+			return nil
+		}
 		for _, kidId := range *comment.Kids {
 			err = traverse(kidId, level+1)
 			if err != nil {
@@ -60,6 +83,9 @@ func GetCommentTree(story model.Item, dl *loader.DataLoader) ([]TraversedComment
 		}
 		return nil
 	}
+	if story.Kids == nil {
+		return nil, nil
+	}
 	for _, commentId := range *story.Kids {
 		err := traverse(commentId, 0)
 		if err != nil {
@@ -69,21 +95,62 @@ func GetCommentTree(story model.Item, dl *loader.DataLoader) ([]TraversedComment
 	return commentTraversal, nil
 }
 
+// parseAt reads the optional at query parameter, an RFC 3339 time to show
+// pages as they were captured then, in UTC. The zero time means now.
+func parseAt(r *http.Request) (time.Time, error) {
+	at := r.URL.Query().Get("at")
+	if at == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	return t.UTC(), err
+}
+
+// formatAt is the at query parameter for links to the moment at, empty for
+// now.
+func formatAt(at time.Time) string {
+	if at.IsZero() {
+		return ""
+	}
+	return at.UTC().Format(time.RFC3339Nano)
+}
+
+// itemGetter returns the latest revision of items, or the revision at at
+// when it is set.
+func (srv *fastHacker) itemGetter(at time.Time) ItemGetter {
+	if at.IsZero() {
+		return srv.dl.GetItem
+	}
+	return func(id model.ItemID) (model.Item, error) {
+		return srv.dl.GetItemAt(id, at)
+	}
+}
+
 func (srv *fastHacker) handleItem(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	if id == "" {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	at, err := parseAt(r)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
 	storyId := model.ItemID(0)
 	fmt.Sscanf(id, "%d", &storyId)
-	story, err := srv.dl.GetItem(storyId)
+	get := srv.itemGetter(at)
+	story, err := get(storyId)
+	if errors.Is(err, eventlog.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
 	if err != nil {
 		log.Printf("handleItem GetStory(%d): %s", storyId, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	commentTree, err := GetCommentTree(story, &srv.dl)
+	commentTree, err := GetCommentTree(story, get)
 	if err != nil {
 		log.Printf("handleItem GetCommentTree(%d): %s", storyId, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -92,6 +159,7 @@ func (srv *fastHacker) handleItem(w http.ResponseWriter, r *http.Request) {
 	data := StoryPage{
 		Story:       &story,
 		CommentTree: commentTree,
+		At:          formatAt(at),
 	}
 	err = srv.itemTmpl.Execute(w, data)
 	if err != nil {
@@ -104,19 +172,49 @@ func (srv *fastHacker) handleDefault(w http.ResponseWriter, r *http.Request) {
 		srv.staticHandler.ServeHTTP(w, r)
 		return
 	}
+	srv.handleList(model.ListTop)(w, r)
+}
+
+func (srv *fastHacker) handleList(name model.ListName) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		at, err := parseAt(r)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		srv.renderList(w, name, at)
+	}
+}
 
-	topStories, err := srv.dl.GetTopStories()
+// renderList shows the stories of a list, as it is now or, when at is set,
+// as it was at that time.
+func (srv *fastHacker) renderList(w http.ResponseWriter, name model.ListName, at time.Time) {
+	var list model.StoryList
+	var err error
+	if at.IsZero() {
+		list, err = srv.dl.GetList(name)
+	} else {
+		list, err = srv.dl.GetListAt(name, at)
+	}
+	if errors.Is(err, eventlog.ErrNotFound) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Printf("handleIndex GetNewsPosts(): %s", err)
+		log.Printf("handleIndex GetList(%s): %s", name, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	get := srv.itemGetter(at)
 	var stories []model.Item
-	for idx, storyId := range topStories {
+	for idx, storyId := range list {
 		if idx > 30 {
 			break
 		}
-		story, err := srv.dl.GetItem(storyId)
+		story, err := get(storyId)
+		if errors.Is(err, eventlog.ErrNotFound) {
+			continue
+		}
 		if err != nil {
 			log.Printf("handleIndex GetStory(%d): %s", storyId, err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -127,6 +225,7 @@ func (srv *fastHacker) handleDefault(w http.ResponseWriter, r *http.Request) {
 	data := StoryListPage{
 		RankOffset: 1,
 		Stories:    stories,
+		At:         formatAt(at),
 	}
 	err = srv.indexTmpl.Execute(w, data)
 	if err != nil {
@@ -134,7 +233,24 @@ func (srv *fastHacker) handleDefault(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (srv *fastHacker) handleFailed(w http.ResponseWriter, r *http.Request) {
+	failures, err := srv.dl.GetFailedFetches()
+	if err != nil {
+		log.Printf("handleFailed GetFailedFetches(): %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	err = srv.failedTmpl.Execute(w, failures)
+	if err != nil {
+		log.Printf("handleFailed template execute(): %s", err)
+	}
+}
+
 func rfc3339(t model.Time) string {
+	return timeRFC3339(t.Time)
+}
+
+func timeRFC3339(t time.Time) string {
 	return t.UTC().Format(time.RFC3339)
 }
 
@@ -149,21 +265,25 @@ func site(s *string) string {
 	return parsedUrl.Host
 }
 
-func Start(es *eventstore.EventStore) {
-	fmt.Println("fasthacker starting")
+var funcMap = template.FuncMap{
+	"add":         func(a, b int) int { return a + b },
+	"multiply":    func(a, b int) int { return a * b },
+	"ago":         ago,
+	"rfc3339":     rfc3339,
+	"timeAgo":     timeAgo,
+	"timeRFC3339": timeRFC3339,
+	"site":        site,
+}
+
+// NewServer builds the web server for es, listening on addr. Stop it with
+// Shutdown.
+func NewServer(es *eventstore.EventStore, addr string) *http.Server {
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	srv := &http.Server{
-		Addr: "localhost:8080",
+		Addr: addr,
 	}
+	srv.RegisterOnShutdown(cancel)
 
-	funcMap := template.FuncMap{
-		"add":      func(a, b int) int { return a + b },
-		"multiply": func(a, b int) int { return a * b },
-		"ago":      ago,
-		"rfc3339":  rfc3339,
-		"site":     site,
-	}
 	indexTmpl := template.New("index.html")
 	indexTmpl.Funcs(funcMap)
 	indexTmpl, err := indexTmpl.ParseFiles("templates/index.html")
@@ -178,17 +298,39 @@ func Start(es *eventstore.EventStore) {
 		log.Fatalf("ParseFiles(): %s", err)
 	}
 
+	failedTmpl := template.New("failed.html")
+	failedTmpl.Funcs(funcMap)
+	failedTmpl, err = failedTmpl.ParseFiles("templates/failed.html")
+	if err != nil {
+		log.Fatalf("ParseFiles(): %s", err)
+	}
+
 	fastHacker := &fastHacker{
 		indexTmpl:     indexTmpl,
 		itemTmpl:      itemTmpl,
+		failedTmpl:    failedTmpl,
 		staticHandler: http.FileServer(http.Dir("static")),
 		dl:            loader.NewLoader(ctx, es),
 	}
-	http.HandleFunc("/", fastHacker.handleDefault)
-	http.HandleFunc("/item", fastHacker.handleItem)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", fastHacker.handleDefault)
+	mux.HandleFunc("/news", fastHacker.handleList(model.ListTop))
+	mux.HandleFunc("/newest", fastHacker.handleList(model.ListNew))
+	mux.HandleFunc("/best", fastHacker.handleList(model.ListBest))
+	mux.HandleFunc("/ask", fastHacker.handleList(model.ListAsk))
+	mux.HandleFunc("/show", fastHacker.handleList(model.ListShow))
+	mux.HandleFunc("/jobs", fastHacker.handleList(model.ListJob))
+	mux.HandleFunc("/item", fastHacker.handleItem)
+	mux.HandleFunc("/failed", fastHacker.handleFailed)
+	srv.Handler = mux
+	return srv
+}
 
-	log.Println("Starting server on http://localhost:8080")
-	err = srv.ListenAndServe()
+// Start serves srv until it is shut down.
+func Start(srv *http.Server) {
+	fmt.Println("fasthacker starting")
+	log.Printf("Starting server on http://%s", srv.Addr)
+	err := srv.ListenAndServe()
 	if err != http.ErrServerClosed {
 		log.Fatalf("ListenAndServe(): %s", err)
 	}
@@ -0,0 +1,105 @@
+package web
+
+import (
+	"html"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	eventlog "github.com/dan-mcdonald/fasthacker/internal/event-log"
+	"github.com/dan-mcdonald/fasthacker/internal/model"
+)
+
+func TestParseAt(t *testing.T) {
+	for query, want := range map[string]time.Time{
+		"":                                  {},
+		"at=2024-05-01T12:30:00Z":           time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		"at=2024-05-01T14:30:00%2B02:00":    time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		"at=2024-05-01T12:30:00.25-01:00":   time.Date(2024, 5, 1, 13, 30, 0, 250e6, time.UTC),
+		"at=2024-05-01T12:30:00.000000001Z": time.Date(2024, 5, 1, 12, 30, 0, 1, time.UTC),
+	} {
+		got, err := parseAt(httptest.NewRequest("GET", "/?"+query, nil))
+		if err != nil || !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("parseAt(%q) = %v, %v, want %v in UTC", query, got, err, want)
+		}
+	}
+	if _, err := parseAt(httptest.NewRequest("GET", "/?at=yesterday", nil)); err == nil {
+		t.Error("parseAt accepted at=yesterday")
+	}
+}
+
+// pastLoader serves one story as it was at any time, and records the times
+// it was asked for.
+type pastLoader struct {
+	asked []time.Time
+}
+
+func (l *pastLoader) GetList(name model.ListName) (model.StoryList, error) {
+	return nil, eventlog.ErrNotFound
+}
+
+func (l *pastLoader) GetItem(id model.ItemID) (model.Item, error) {
+	return model.Item{}, eventlog.ErrNotFound
+}
+
+func (l *pastLoader) GetListAt(name model.ListName, at time.Time) (model.StoryList, error) {
+	l.asked = append(l.asked, at)
+	return model.StoryList{1}, nil
+}
+
+func (l *pastLoader) GetItemAt(id model.ItemID, at time.Time) (model.Item, error) {
+	l.asked = append(l.asked, at)
+	title := "A story"
+	return model.Item{ID: id, Type: "story", Title: &title}, nil
+}
+
+func (l *pastLoader) GetUser(id model.UserID) (model.User, error) {
+	return model.User{}, eventlog.ErrNotFound
+}
+
+func (l *pastLoader) GetFailedFetches() ([]model.FailedFetch, error) {
+	return nil, nil
+}
+
+func TestListCarriesAtIntoLinks(t *testing.T) {
+	indexTmpl, err := template.New("index.html").Funcs(funcMap).ParseFiles("../../templates/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := &pastLoader{}
+	srv := &fastHacker{indexTmpl: indexTmpl, dl: dl}
+
+	w := httptest.NewRecorder()
+	srv.handleList(model.ListTop)(w, httptest.NewRequest("GET", "/news?at=2024-05-01T14:30:00.5%2B02:00", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	want := time.Date(2024, 5, 1, 12, 30, 0, 500e6, time.UTC)
+	for _, at := range dl.asked {
+		if !at.Equal(want) || at.Location() != time.UTC {
+			t.Errorf("loader asked for %v, want %v", at, want)
+		}
+	}
+	links := regexp.MustCompile(`href="(item\?[^"]*)"`).FindAllStringSubmatch(w.Body.String(), -1)
+	if len(links) == 0 {
+		t.Fatalf("no item links in %s", w.Body)
+	}
+	for _, link := range links {
+		u, err := url.Parse(html.UnescapeString(link[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.Query().Get("at"); got != "2024-05-01T12:30:00.5Z" {
+			t.Errorf("link %s carries at=%s, want it in UTC", link[1], got)
+		}
+		// The link's at must parse back to the same moment.
+		at, err := parseAt(httptest.NewRequest("GET", "/"+u.String(), nil))
+		if err != nil || !at.Equal(want) {
+			t.Errorf("link %s carries at %v, %v, want %v", link[1], at, err, want)
+		}
+	}
+}